@@ -2,7 +2,12 @@ package main
 
 import (
 	"./parse"
+	"errors"
 	"fmt"
+	fmath "math"
+	"os"
+	"strconv"
+	"strings"
 	// "github.com/davecheney/profile"
 	"time"
 )
@@ -10,7 +15,7 @@ import (
 /////////////////////// Example ////////////////////////
 
 var math = parse.Grammar{
-	"digit":    "'0'|'1'|'2'|'3'|'4'|'5'|'6'|'7'|'8'|'9'",
+	"digit":    "<0-9>",
 	"sign":     ` '+'|'-' `,
 	"operator": " '*'|'/'|'+'|'-'|'^' ",
 	"digits":   "digit & [digit] ",
@@ -20,82 +25,183 @@ var math = parse.Grammar{
 	"expression": "component & [{operator & component}]",
 }
 
-var json = parse.Grammar{
-	"object": `  '{}'
-			  |{ '{' & members & '}' } `,
+// the json grammar of json.org, which is kept in a file, as it is
+// tested along with the parse package
+const jsonFile = "parse/testdata/json.peg"
 
-	"members": `{ pair & ',' & members }  
-				| pair `,
-
-	"pair": ` string & ':' & value `,
-
-	"array": `  '[]'
-			 |{ '[' & elements & ']' } `,
-
-	"elements": `{ value & ',' & elements } 
-				 | value `,
-
-	"value": ` 'true'
-			 | 'false'
-			 | 'null'
-			 | string
-			 | number
-			 | object
-			 | array `,
+// reads a grammar from a file, see parse.ParseGrammarFile
+func readGrammar(path string) (parse.Grammar, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
 
-	"string": `  '""'
-			  |{ '"' & chars & '"' } `,
+	f, err := parse.ParseGrammarFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return f.Grammar, nil
+}
 
-	"chars": `{ char & chars}  
-			  | char `,
+/////////////////////// Actions ////////////////////////
 
-	"char": ` *'\"'
-			| '\"'
-			| '\\'
-			| '\/'
-			| '\b'
-			| '\f'
-			| '\n'
-			| '\r'
-			| '\t'
-			|{'\u' & hexa & hexa & hexa & hexa } `,
+// evaluates math expressions to a float64
+var mathActions = map[string]parse.Action{
+	"number": func(n *parse.Cst) (interface{}, error) {
+		text := strings.Trim(n.Text(), "()")
+		return strconv.ParseFloat(text, 64)
+	},
+	"component": func(n *parse.Cst) (interface{}, error) {
+		child := n.Child(0)
+		if child.Type() == "number" {
+			return child.Result(), nil
+		}
+		// parenthesized expression
+		return child.Child(1).Result(), nil
+	},
+	"expression": func(n *parse.Cst) (interface{}, error) {
+		values := []float64{n.Child(0).Result().(float64)}
+		operators := []string{}
 
-	"hexa": ` digit 
-			| 'a' | 'b' | 'c' | 'd' | 'e' | 'f'  
-			| 'A' | 'B' | 'C' | 'D' | 'E' | 'F'  `,
+		for _, operation := range n.Child(1).Children() {
+			operators = append(operators, operation.Child(0).Text())
+			values = append(values, operation.Child(1).Result().(float64))
+		}
+		return evaluate(values, operators)
+	},
+}
 
-	"digit": " '0'|'1'|'2'|'3'|'4'|'5'|'6'|'7'|'8'|'9' ",
+// applies the operators in order of precedence: ^ (from the right),
+// then * and /, then + and -
+func evaluate(values []float64, operators []string) (float64, error) {
+	reduce := func(i int, value float64) {
+		values[i] = value
+		values = append(values[:i+1], values[i+2:]...)
+		operators = append(operators[:i], operators[i+1:]...)
+	}
 
-	"otn": " '1'|'2'|'3'|'4'|'5'|'6'|'7'|'8'|'9' ",
+	for i := len(operators) - 1; i >= 0; i-- {
+		if operators[i] == "^" {
+			reduce(i, fmath.Pow(values[i], values[i+1]))
+		}
+	}
 
-	"number": `{ int & frac & exp } 
-			  |{ int & frac }
-			  |{ int & exp }
-			  |  int`,
+	for _, precedence := range []string{"*/", "+-"} {
+		for i := 0; i < len(operators); {
+			a, b := values[i], values[i+1]
 
-	"int": `{ '-' & otn & digits } 
-		   |{ '-' & digit }
-		   |{ otn & digits }
-		   |  digit `,
+			switch {
+			case !strings.Contains(precedence, operators[i]):
+				i++
+			case operators[i] == "*":
+				reduce(i, a*b)
+			case operators[i] == "/" && b == 0:
+				return 0, errors.New("division by zero")
+			case operators[i] == "/":
+				reduce(i, a/b)
+			case operators[i] == "+":
+				reduce(i, a+b)
+			case operators[i] == "-":
+				reduce(i, a-b)
+			}
+		}
+	}
+	return values[0], nil
+}
 
-	"frac": " '.' & digits ",
+type member struct {
+	key   string
+	value interface{}
+}
 
-	"exp": " e & digits ",
+// collects the results of a list such as 'members' or 'elements'
+func collect(n *parse.Cst) []interface{} {
+	child := n.Child(0)
+	if child.Type() == "And" {
+		rest := child.Child(2).Result().([]interface{})
+		return append([]interface{}{child.Child(0).Result()}, rest...)
+	}
+	return []interface{}{child.Result()}
+}
 
-	"digits": ` { digit & digits } | digit `,
+// builds the maps, slices, strings, float64s, bools and nils of json
+var jsonActions = map[string]parse.Action{
+	"object": func(n *parse.Cst) (interface{}, error) {
+		object := map[string]interface{}{}
+		if members := n.Child(0).ChildByType("members"); members != nil {
+			for _, m := range members.Result().([]interface{}) {
+				object[m.(member).key] = m.(member).value
+			}
+		}
+		return object, nil
+	},
+	"members": func(n *parse.Cst) (interface{}, error) {
+		return collect(n), nil
+	},
+	"pair": func(n *parse.Cst) (interface{}, error) {
+		key := n.ChildByType("string").Result().(string)
+		return member{key, n.ChildByType("value").Result()}, nil
+	},
+	"array": func(n *parse.Cst) (interface{}, error) {
+		if elements := n.Child(0).ChildByType("elements"); elements != nil {
+			return elements.Result(), nil
+		}
+		return []interface{}{}, nil
+	},
+	"elements": func(n *parse.Cst) (interface{}, error) {
+		return collect(n), nil
+	},
+	"value": func(n *parse.Cst) (interface{}, error) {
+		child := n.Child(1).Child(0)
+		switch child.Text() {
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		case "null":
+			return nil, nil
+		}
+		return child.Result(), nil
+	},
+	"string": func(n *parse.Cst) (interface{}, error) {
+		// json escapes are those of Go, plus \/
+		return strconv.Unquote(strings.Replace(n.Text(), `\/`, "/", -1))
+	},
+	"number": func(n *parse.Cst) (interface{}, error) {
+		return strconv.ParseFloat(n.Text(), 64)
+	},
+}
 
-	"e": ` 'e+' | 'e-' | 'E+' | 'E-' | 'e' | 'E' `,
+// compiles the grammar & attaches the given actions to its rules
+func withActions(g parse.Grammar, actions map[string]parse.Action) (*parse.CompiledGrammar, error) {
+	compiled, err := g.Compile()
+	if err != nil {
+		return nil, err
+	}
+	for rule, action := range actions {
+		if err := compiled.SetAction(rule, action); err != nil {
+			return nil, err
+		}
+	}
+	return compiled, nil
 }
 
 func IsValid(g parse.Grammar, ruleName string, input string) bool {
-	lex := parse.NewLexer(parse.RmWhiteSpace(input))
-	parser := g.GetParser(ruleName)
+	lex := parse.NewLexer(input)
+	parser, err := g.GetParser(ruleName)
+	if err != nil {
+		return false
+	}
 	matches, _ := parser(lex)
 	return matches && lex.Done()
 }
 
 func timef(p parse.Parser, s string, iters int) {
 	lex := parse.NewLexer(s)
+	// without memoization, every level of nesting doubles the work
+	// done by rules such as 'members'
+	lex.EnablePackrat()
 	start := time.Now()
 
 	for i := 0; i < iters; i++ {
@@ -138,11 +244,66 @@ func main() {
 		}
 	}`
 
+	json, err := readGrammar(jsonFile)
+	if err != nil {
+		log(err)
+		return
+	}
+
+	// check every rule of the grammars before parsing anything
+	for start, g := range map[string]parse.Grammar{"object": json, "expression": math} {
+		if err := g.Validate(start); err != nil {
+			log(g.Diagnose(err, 2))
+			return
+		}
+	}
+
 	// this will benchmark the parser over the given number of iterations
-	jsonParser := json.GetParser("object")
+	compiled, err := json.Compile()
+	if err != nil {
+		log(json.Diagnose(err, 2))
+		return
+	}
+	jsonParser, _ := compiled.GetParser("object")
 	timef(jsonParser, input, 1000)
 
+	// the same grammar as a program for the parsing machine, which
+	// builds the same trees without a closure per expression
+	program, err := json.CompileProgram()
+	if err != nil {
+		log(json.Diagnose(err, 2))
+		return
+	}
+	programParser, _ := program.GetParser("object")
+	timef(programParser, input, 1000)
+
 	// test the math and json parsers
 	log(IsValid(json, "object", input))                                         // true
 	log(IsValid(math, "expression", "1+(1+(1+(1+(1+(1+(1+(1+(1+(1+1)))))))))")) // true
+
+	// the furthest point reached explains why the input was invalid
+	invalid := "{\n\t\"a\": 1 x\n}"
+	_, err = compiled.Parse("object", invalid)
+	log(parse.Diagnose(err, invalid, 1))
+	// parsing "object": line 2 col 9: expected < \t\n\r>, ',' or '}', found 'x'
+	//  1 | {
+	//  2 | 	"a": 1 x
+	//    | 	       ^
+	//  3 | }
+
+	// evaluate math & json with the actions attached to their rules
+	calculator, err := withActions(math, mathActions)
+	if err != nil {
+		log(math.Diagnose(err, 2))
+		return
+	}
+	log(calculator.Eval("expression", "2^3^2-(1+2)*3")) // 503 <nil>
+	log(calculator.Eval("expression", "1/(1-1)"))       // <nil> ... division by zero
+
+	decoder, err := withActions(json, jsonActions)
+	if err != nil {
+		log(json.Diagnose(err, 2))
+		return
+	}
+	log(decoder.Eval("object", `{"a": [1, true, {"b": null}], "c": "d\u00e9"}`))
 }
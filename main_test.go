@@ -0,0 +1,56 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestMathActions(t *testing.T) {
+	calculator, err := withActions(math, mathActions)
+	assert.NoError(t, err)
+
+	for input, expected := range map[string]float64{
+		"1+2*3":         7,
+		"2^3^2-(1+2)*3": 503,
+		"8/4/2":         1,
+		"10-2-3":        5,
+		"2*(3+4)^2":     98,
+		"1e2+(-3)":      97,
+		"(+5)":          5,
+		"((1)+(2))*3":   9,
+	} {
+		value, err := calculator.Eval("expression", input)
+		assert.NoError(t, err, input)
+		assert.Equal(t, expected, value, input)
+	}
+
+	_, err = calculator.Eval("expression", "1/(1-1)")
+	assert.EqualError(t, err, `parsing "expression": line 1 col 1: division by zero`)
+}
+
+func TestEvaluate(t *testing.T) {
+	value, err := evaluate([]float64{1, 2, 3, 2}, []string{"+", "*", "^"})
+	assert.NoError(t, err)
+	assert.Equal(t, 19.0, value, "^ binds tighter than *, which binds tighter than +")
+
+	value, err = evaluate([]float64{4}, []string{})
+	assert.NoError(t, err)
+	assert.Equal(t, 4.0, value)
+}
+
+func TestJSONActions(t *testing.T) {
+	json, err := readGrammar(jsonFile)
+	assert.NoError(t, err)
+	decoder, err := withActions(json, jsonActions)
+	assert.NoError(t, err)
+
+	value, err := decoder.Eval("object", `{"a": [1, true, {"b": null}], "c": "dé\/", "e": {}, "f": [], "g": -2.5e1}`)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"a": []interface{}{1.0, true, map[string]interface{}{"b": nil}},
+		"c": "dé/",
+		"e": map[string]interface{}{},
+		"f": []interface{}{},
+		"g": -25.0,
+	}, value)
+}
@@ -0,0 +1,445 @@
+package parse
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+/////////////////////// Grammar Analysis ////////////////////////
+
+/*
+	Some properties of a grammar can be worked out without parsing
+	any input. A rule is nullable if it can match without consuming
+	anything, and its FIRST set holds the literals, classes and
+	wildcards which may match the first of the input it consumes.
+
+	Both depend on the rules referred to, which may refer back, so
+	they are computed for every rule at once: starting from nothing,
+	each rule is reconsidered in light of the others until nothing
+	changes.
+
+	A repetition of a nullable expression, such as [(x)], would match
+	nothing forever. Many stops such a loop as soon as it happens, but
+	it is always a mistake in the grammar, so it is rejected when the
+	grammar is compiled.
+
+	A rule which may call itself before consuming anything is left
+	recursive. Such a rule would recurse forever, unless the lexer
+	grows a seed match for it (see packrat.go), which costs a reparse
+	for every step that the match grows, and isn't supported by
+	generated parsers. So Compile rejects left recursion, explaining
+	the path of each cycle, unless CompileLeftRecursive is used to ask
+	for seed growing instead. LeftRecursion reports each cycle too.
+
+	Or takes the first alternative to match, so an alternative may be
+	shadowed by an earlier one which matches whenever it would, as in
+	'e' | 'e+'. Parsing is deterministic, so this is certain if the
+	earlier alternative matches the same steps as the start of the
+	later one, where each character of a literal is a step of its own,
+	or if the earlier alternative can't fail at all, as with ('x').
+*/
+
+var (
+	// a repetition, such as [...] or *, of an expression which may
+	// match without consuming input
+	ErrNullableRepetition = errors.New("repeats an expression which may match nothing")
+
+	// a rule which may call itself before consuming any input
+	ErrLeftRecursion = errors.New("left recursive")
+
+	// an alternative which can never match, as an earlier alternative
+	// always matches first
+	ErrShadowedAlternative = errors.New("unreachable alternative")
+)
+
+// An Analysis holds what is known of the rules of a Grammar before any
+// input is parsed.
+type Analysis struct {
+	grammar    Grammar
+	trees      map[string]*Cst // the parsed shorthand of each valid rule
+	offsets    map[string][]int
+	nullable   map[string]bool
+	infallible map[string]bool // rules which always match
+	first      map[string]map[string]bool
+	calls      map[string][]string // rules called before consuming input
+
+	// used to decode literals and classes
+	compiled *CompiledGrammar
+}
+
+// what is known of an expression
+type facts struct {
+	nullable   bool
+	infallible bool
+	first      map[string]bool
+	calls      []string
+}
+
+// computes the nullability, FIRST set and left calls of every rule.
+// Rules whose shorthand doesn't compile are left out, as they are
+// reported by Compile and Validate.
+func (g Grammar) Analyze() *Analysis {
+	a := &Analysis{
+		grammar:    g,
+		trees:      map[string]*Cst{},
+		offsets:    map[string][]int{},
+		nullable:   map[string]bool{},
+		infallible: map[string]bool{},
+		first:      map[string]map[string]bool{},
+		calls:      map[string][]string{},
+		compiled:   newCompiledGrammar(g),
+	}
+
+	for _, name := range g.names() {
+		if tree, err := a.compiled.parseRule(name); err == nil {
+			a.trees[name] = tree
+			a.offsets[name] = a.compiled.offsets
+		}
+	}
+
+	for changed := true; changed; {
+		changed = false
+
+		for name, tree := range a.trees {
+			f := a.facts(tree)
+
+			if f.nullable != a.nullable[name] || f.infallible != a.infallible[name] ||
+				len(f.first) != len(a.first[name]) {
+				changed = true
+			}
+			a.nullable[name] = f.nullable
+			a.infallible[name] = f.infallible
+			a.first[name] = f.first
+			a.calls[name] = f.calls
+		}
+	}
+	return a
+}
+
+// returns whether the rule can match without consuming any input
+func (a *Analysis) Nullable(rule string) bool {
+	return a.nullable[rule]
+}
+
+// returns the descriptions of the literals, classes and wildcards which
+// may begin a match of the rule, in alphabetical order
+func (a *Analysis) First(rule string) []string {
+	first := []string{}
+	for item := range a.first[rule] {
+		first = append(first, item)
+	}
+	sort.Strings(first)
+	return first
+}
+
+// returns GrammarErrors describing each left recursive cycle in the
+// grammar, such as expr -> term -> expr, or nil if there are none
+func (a *Analysis) LeftRecursion() error {
+	errs := GrammarErrors{}
+	reported := map[string]bool{}
+
+	for _, name := range a.grammar.names() {
+		if reported[name] {
+			continue
+		}
+
+		path := a.cycle(name)
+		if path == nil {
+			continue
+		}
+		for _, rule := range path {
+			reported[rule] = true
+		}
+		errs = append(errs, leftRecursionError(path))
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// describes the left recursive cycle starting from the first rule of
+// the path
+func leftRecursionError(path []string) *GrammarError {
+	return &GrammarError{
+		Rule: path[0],
+		Err:  fmt.Errorf("%w: %s", ErrLeftRecursion, strings.Join(path, " -> ")),
+	}
+}
+
+// returns the shortest path of left calls from the rule back to
+// itself, or nil if there is none
+func (a *Analysis) cycle(rule string) []string {
+	from := map[string]string{}
+	queue := []string{rule}
+
+	for len(queue) > 0 {
+		name := queue[0]
+		queue = queue[1:]
+
+		for _, next := range a.calls[name] {
+			if next == rule {
+				path := []string{rule}
+				for step := name; step != rule; step = from[step] {
+					path = append([]string{step}, path...)
+				}
+				return append([]string{rule}, path...)
+			}
+			if _, seen := from[next]; !seen {
+				from[next] = name
+				queue = append(queue, next)
+			}
+		}
+	}
+	return nil
+}
+
+// works out the facts of a node of the shorthand, given what is known
+// so far of the rules
+func (a *Analysis) facts(node *Cst) facts {
+	switch node.typ {
+	case "expression", "sequence":
+		isSequence := node.typ == "sequence"
+		f := facts{nullable: isSequence, infallible: isSequence, first: map[string]bool{}}
+
+		// whether the parts so far may all match nothing, so that the
+		// next one begins where the sequence does
+		leading := true
+
+		for _, part := range elements(node) {
+			pf := a.facts(part)
+			if !isSequence {
+				f.nullable = f.nullable || pf.nullable
+				f.infallible = f.infallible || pf.infallible
+			} else {
+				// any part may fail, however much input came before
+				f.infallible = f.infallible && pf.infallible
+				if !leading {
+					continue
+				}
+			}
+
+			for item := range pf.first {
+				f.first[item] = true
+			}
+			f.calls = append(f.calls, pf.calls...)
+
+			if isSequence && !pf.nullable {
+				// the rest of the sequence follows consumed input
+				f.nullable, leading = false, false
+			}
+		}
+		return f
+
+	case "prefixed":
+		f := a.facts(node.nthChild(1))
+		if len(node.nthChild(0).children) > 0 {
+			// predicates only look at what follows, and & can't fail
+			// if what it looks for can't
+			infallible := f.infallible && !strings.Contains(node.nthChild(0).Text(), "!")
+			return facts{true, infallible, map[string]bool{}, f.calls}
+		}
+		return f
+
+	case "term":
+		f := a.facts(node.nthChild(0))
+		for _, quantifier := range node.nthChild(1).children {
+			child := quantifier.nthChild(0)
+			switch child.value {
+			case "?", "*":
+				f.nullable, f.infallible = true, true
+			case "+":
+			default:
+				if min, _, err := boundsOf(child, a.compiled); err == nil && min == 0 {
+					f.nullable, f.infallible = true, true
+				}
+			}
+		}
+		if recovery := node.nthChild(2); len(recovery.children) > 0 {
+			// a recovery point only matches nothing when there is
+			// nothing to skip, which is how a repetition of one, such
+			// as [statement ~ ';'], is meant to stop. So it is counted
+			// as nullable only if the term is, but it does look for
+			// its synchronization point from where the term began.
+			f.calls = append(f.calls, a.facts(recovery.nthChild(0).nthChild(1)).calls...)
+			f.infallible = true
+		}
+		return f
+
+	case "component":
+		child := node.nthChild(0)
+		if child.typ == "And" {
+			return a.facts(child.nthChild(1))
+		}
+		return a.facts(child)
+
+	case "many", "optional":
+		f := a.facts(node.nthChild(1))
+		f.nullable, f.infallible = true, true
+		return f
+
+	case "reference":
+		name := node.Text()
+		return facts{a.nullable[name], a.infallible[name], a.first[name], []string{name}}
+
+	case "end":
+		return facts{nullable: true, first: map[string]bool{}}
+
+	case "literal":
+		if len(node.nthChild(1).children) == 0 {
+			return facts{nullable: true, infallible: true, first: map[string]bool{}}
+		}
+	}
+
+	return facts{first: map[string]bool{a.describe(node): true}}
+}
+
+// returns GrammarErrors describing each alternative which can never
+// match because of an earlier one, or nil if there are none
+func (a *Analysis) ShadowedAlternatives() error {
+	errs := GrammarErrors{}
+
+	for _, name := range a.grammar.names() {
+		tree, ok := a.trees[name]
+		if !ok {
+			continue
+		}
+		a.compiled.rule, a.compiled.offsets = name, a.offsets[name]
+
+		var walk func(*Cst)
+		walk = func(node *Cst) {
+			for _, child := range node.children {
+				walk(child)
+			}
+			if node.typ == "expression" {
+				errs = append(errs, a.shadowed(node)...)
+			}
+		}
+		walk(tree)
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// finds the alternatives of an expression shadowed by earlier ones
+func (a *Analysis) shadowed(expression *Cst) GrammarErrors {
+	errs := GrammarErrors{}
+	alternatives := elements(expression)
+	steps := make([][]string, len(alternatives))
+
+	for i, alternative := range alternatives {
+		steps[i] = a.steps(alternative)
+
+		for j := 0; j < i; j++ {
+			if !a.facts(alternatives[j]).infallible && !hasPrefix(steps[i], steps[j]) {
+				continue
+			}
+			err := a.compiled.errorAt(alternative.start, "", "").(*GrammarError)
+			err.Err = fmt.Errorf("%w: %s, as %s matches first",
+				ErrShadowedAlternative, shorthandText(alternative), shorthandText(alternatives[j]))
+			errs = append(errs, err)
+			break
+		}
+	}
+	return errs
+}
+
+// breaks a sequence down into the steps it matches, in order. Each
+// character of a literal is a step of its own, and groups such as
+// { 'a' & b } are opened up, so that 'ab' & c begins with 'a' & b.
+// Anything else is a single step, named by its text.
+func (a *Analysis) steps(sequence *Cst) []string {
+	steps := []string{}
+
+	for _, prefixed := range elements(sequence) {
+		term := prefixed.nthChild(1)
+		child := term.nthChild(0).nthChild(0)
+		plain := len(prefixed.nthChild(0).children) == 0 &&
+			len(term.nthChild(1).children) == 0 &&
+			len(term.nthChild(2).children) == 0
+
+		if plain && child.typ == "literal" {
+			if chars, err := literalChars(child, a.compiled); err == nil {
+				for _, char := range chars {
+					steps = append(steps, quote(char))
+				}
+				continue
+			}
+		}
+		if plain && child.typ == "And" && len(child.nthChild(1).nthChild(1).children) == 0 {
+			steps = append(steps, a.steps(child.nthChild(1).nthChild(0))...)
+			continue
+		}
+		steps = append(steps, shorthandText(prefixed))
+	}
+	return steps
+}
+
+func hasPrefix(steps []string, prefix []string) bool {
+	if len(prefix) > len(steps) {
+		return false
+	}
+	for i := range prefix {
+		if steps[i] != prefix[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// returns the elements of an expression or sequence: its sequences or
+// its prefixed terms
+func elements(node *Cst) []*Cst {
+	parts := []*Cst{node.nthChild(0)}
+	for _, child := range node.nthChild(1).children {
+		parts = append(parts, child.nthChild(1))
+	}
+	return parts
+}
+
+// returns the stripped text of a node of the shorthand
+func shorthandText(node *Cst) string {
+	return node.src.input[node.start:node.end]
+}
+
+// describes a literal, class or wildcard as it would be expected
+func (a *Analysis) describe(node *Cst) string {
+	switch node.typ {
+	case "literal":
+		if chars, err := literalChars(node, a.compiled); err == nil {
+			return quote(strings.Join(chars, ""))
+		}
+	case "wildcard":
+		if chars, err := literalChars(node.nthChild(1), a.compiled); err == nil {
+			return describeWildcard(strings.Join(chars, ""))
+		}
+	case "class":
+		if negated, ranges, err := classRanges(node, a.compiled); err == nil {
+			return describeClass(negated, ranges)
+		}
+	}
+	return node.Text()
+}
+
+// returns the analysis of the grammar being compiled
+func (c *CompiledGrammar) analysis() *Analysis {
+	if c.analyzed == nil {
+		c.analyzed = c.grammar.Analyze()
+	}
+	return c.analyzed
+}
+
+// builds a *GrammarError for a repetition, at the given offset into
+// the stripped text of the rule being compiled, which repeats an
+// expression that may match nothing
+func (c *CompiledGrammar) nullableRepetition(pos int, repeated string) error {
+	err := c.errorAt(pos, "", "").(*GrammarError)
+	err.Err = fmt.Errorf("%w: %s", ErrNullableRepetition, repeated)
+	return err
+}
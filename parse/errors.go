@@ -0,0 +1,269 @@
+package parse
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+/////////////////////// Errors ////////////////////////
+
+// A GrammarError describes a rule whose shorthand could not be compiled.
+type GrammarError struct {
+	Rule     string // name of the offending rule
+	Offset   int    // byte offset of the problem within the rule text
+	Expected string // what the shorthand parser expected at Offset
+	Found    string // what was there instead, if anything
+	Err      error  // what is wrong with the rule as a whole, if anything
+}
+
+func (e *GrammarError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("rule %q: offset %d: %v", e.Rule, e.Offset, e.Err)
+	}
+
+	msg := fmt.Sprintf("rule %q: offset %d: expected %s",
+		e.Rule, e.Offset, e.Expected)
+
+	if len(e.Found) > 0 {
+		msg += ", found " + e.Found
+	}
+	return msg
+}
+
+func (e *GrammarError) Unwrap() error {
+	return e.Err
+}
+
+// GrammarErrors lists every problem found with a grammar, by rule. See
+// Grammar.Validate.
+type GrammarErrors []*GrammarError
+
+func (e GrammarErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+func (e GrammarErrors) Unwrap() []error {
+	errs := make([]error, len(e))
+	for i, err := range e {
+		errs[i] = err
+	}
+	return errs
+}
+
+/*
+	When the input doesn't match, the position which was reached
+	before failing tends to be more interesting than the position
+	where the parse gave up, which after backtracking is usually the
+	start of the input. So the lexer tracks the furthest position at
+	which any parser failed, and what each of those parsers expected
+	to find there, as a failure (see runtime.go).
+*/
+
+// records that the given thing was expected at the current position
+func (l *Lexer) expect(expected string) {
+	l.failure.expectAt(l.pos(), expected)
+}
+
+func (l *Lexer) expectAt(pos int, expected string) {
+	l.failure.expectAt(pos, expected)
+}
+
+func (l *Lexer) expectInstead(mark failure, start int, expected string) {
+	l.failure.instead(mark, start, expected)
+}
+
+func (l *Lexer) expectWithin(mark failure, inner failure) {
+	l.failure.within(mark, inner)
+}
+
+// matches the given parser as a single token, so that failing part way
+// through reports the whole token as expected rather than its parts
+func token(parser Parser, expected string) Parser {
+	return func(l *Lexer, n ...string) (bool, *Cst) {
+		start := l.pos()
+		mark := l.failure
+		matches, node := parser(l, n...)
+
+		if !matches {
+			l.failure = mark
+			l.expectAt(start, expected)
+		}
+		return matches, node
+	}
+}
+
+// quotes a literal for use in error messages
+func quote(s string) string {
+	q := strconv.Quote(s)
+	q = strings.Replace(q[1:len(q)-1], `\"`, `"`, -1)
+	return "'" + strings.Replace(q, "'", `\'`, -1) + "'"
+}
+
+// describes a wildcard, e.g. any character but '"\\'
+func describeWildcard(except string) string {
+	if len(except) == 0 {
+		return "any character"
+	}
+	return "any character but " + quote(except)
+}
+
+// describes a character class in the shorthand notation, e.g. <^a-z>
+func describeClass(negated bool, ranges []RuneRange) string {
+	char := func(r rune) string {
+		if strings.ContainsRune(`<>-^\`, r) {
+			return `\` + string(r)
+		}
+		q := strconv.QuoteRune(r)
+		return q[1 : len(q)-1]
+	}
+
+	class := "<"
+	if negated {
+		class += "^"
+	}
+	for _, rng := range ranges {
+		class += char(rng.Lo)
+		if rng.Hi > rng.Lo {
+			class += "-" + char(rng.Hi)
+		}
+	}
+	return class + ">"
+}
+
+// describes the rune at the given position for use in error messages
+func foundAt(l *Lexer, pos int, atEnd string) string {
+	return l.runeAt(pos, atEnd)
+}
+
+// describes the next rune of the lexer for use in error messages
+func found(l *Lexer, atEnd string) string {
+	return foundAt(l, l.pos(), atEnd)
+}
+
+// describes why the lexer stopped: the furthest point at which a parser
+// failed, unless an action rejected a match reaching that point
+func newParseError(l *Lexer, rule string) *ParseError {
+	if l.actionErr != nil && l.actionEnd >= l.failure.pos {
+		err := *l.actionErr
+		err.Rule = rule
+		return &err
+	}
+
+	return l.failedAt(l.failure, l.pos(), rule)
+}
+
+/////////////////////// Diagnostics ////////////////////////
+
+// Renders an error for people to read: the message, followed by the
+// line of text at which the error occurred with a ^ under the column,
+// and up to context lines either side of it. The text is the input for
+// a *ParseError, or the rule text for a *GrammarError (see
+// Grammar.Diagnose). Each of ParseErrors is rendered in turn, and other
+// errors by their message alone.
+//
+//	parsing "pair": line 2 col 3: expected ')', found ' '
+//	 1 | (1,
+//	 2 |  2 x
+//	   |   ^
+func Diagnose(err error, text string, context int) string {
+	var errs ParseErrors
+	if errors.As(err, &errs) {
+		diagnoses := make([]string, len(errs))
+		for i, err := range errs {
+			diagnoses[i] = Diagnose(err, text, context)
+		}
+		return strings.Join(diagnoses, "\n")
+	}
+
+	offset := -1
+
+	var perr *ParseError
+	var gerr *GrammarError
+	if errors.As(err, &perr) {
+		offset = perr.Offset
+	} else if errors.As(err, &gerr) {
+		offset = gerr.Offset
+	}
+
+	if offset < 0 || offset > len(text) {
+		return err.Error()
+	}
+	return err.Error() + "\n" + annotate(newSource(text), offset, context)
+}
+
+// renders a *GrammarError against the text of the offending rule, or
+// each of GrammarErrors in turn
+func (g Grammar) Diagnose(err error, context int) string {
+	var errs GrammarErrors
+	if errors.As(err, &errs) {
+		diagnoses := make([]string, len(errs))
+		for i, err := range errs {
+			diagnoses[i] = g.Diagnose(err, context)
+		}
+		return strings.Join(diagnoses, "\n")
+	}
+
+	var gerr *GrammarError
+	if !errors.As(err, &gerr) || !g.has(gerr.Rule) {
+		return err.Error()
+	}
+	return Diagnose(err, g[gerr.Rule], context)
+}
+
+// renders the lines around the given offset, marking it with a caret
+func annotate(src *source, offset int, context int) string {
+	at := src.locate(offset)
+
+	first := at.Line - context
+	if first < 1 {
+		first = 1
+	}
+	last := at.Line + context
+	if last > len(src.lines) {
+		last = len(src.lines)
+	}
+
+	width := len(strconv.Itoa(last))
+	gutter := func(label string) string {
+		return fmt.Sprintf(" %*s | ", width, label)
+	}
+
+	var out strings.Builder
+	for n := first; n <= last; n++ {
+		line := src.line(n)
+		out.WriteString(strings.TrimRight(gutter(strconv.Itoa(n))+line, " "))
+		out.WriteString("\n")
+
+		if n == at.Line {
+			// line up the caret under tabs as well as spaces
+			column := offset - src.lines[n-1]
+			if column > len(line) {
+				column = len(line) // within the line ending
+			}
+			prefix := line[:column]
+			marker := strings.Map(func(r rune) rune {
+				if r == '\t' {
+					return r
+				}
+				return ' '
+			}, prefix)
+			out.WriteString(gutter("") + marker + "^\n")
+		}
+	}
+	return strings.TrimSuffix(out.String(), "\n")
+}
+
+// returns the text of the nth line, without its line ending
+func (s *source) line(n int) string {
+	end := len(s.input)
+	if n < len(s.lines) {
+		end = s.lines[n] - 1
+	}
+	return strings.TrimSuffix(s.input[s.lines[n-1]:end], "\r")
+}
@@ -0,0 +1,629 @@
+package parse
+
+import (
+	"bytes"
+	_ "embed"
+	"fmt"
+	"go/ast"
+	"go/format"
+	goparser "go/parser"
+	gotoken "go/token"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/////////////////////// Code Generation ////////////////////////
+
+/*
+	A CompiledGrammar parses by calling through the closures built
+	from the shorthand of its rules, and that shorthand is parsed anew
+	every time a program starts. Generate instead writes the Go source
+	of a parser for the grammar, with a method for each rule (and for
+	each expression within a rule), which depends on nothing but the
+	standard library. e.g. for
+
+		pair = '(' & digit & ')' ;
+
+	it writes a method rule_pair, which matches the literals itself
+	and calls the method for digit through the memo table.
+
+	The generated parser builds the same trees, and reports the same
+	errors, as a CompiledGrammar does with packrat parsing enabled. It
+	has its own copy of the Cst, ParseError, ParseErrors, Position and
+	Span types of this package, taken from the source of runtime.go as
+	it was compiled into the package, along with functions Parse and
+	ParseRule. Grammars with left recursion are rejected, as are
+	actions, which live in Go rather than in the grammar.
+*/
+
+// writes the source of a standalone parser for the grammar to w, in
+// the given package, whose Parse function begins with the start rule.
+// See the parsegen command for use with go generate.
+func (g Grammar) Generate(w io.Writer, pkg string, start string) error {
+	return generate(w, g, g.names(), pkg, start)
+}
+
+// writes the source of a standalone parser for the grammar, with its
+// methods in the order the rules were declared, beginning with the
+// first rule
+func (f *GrammarFile) Generate(w io.Writer, pkg string) error {
+	return generate(w, f.Grammar, f.Order, pkg, f.Start())
+}
+
+func generate(w io.Writer, g Grammar, order []string, pkg string, start string) error {
+	if _, err := g.Compile(); err != nil {
+		return err
+	}
+	if !g.has(start) {
+		return &GrammarError{Rule: start, Expected: "a rule definition"}
+	}
+
+	// left recursion has been rejected by Compile
+	gen := &generator{analysis: g.Analyze()}
+	for _, name := range order {
+		gen.rule(name)
+	}
+
+	var src bytes.Buffer
+	fmt.Fprintf(&src, "// Code generated by parsegen. DO NOT EDIT.\n\npackage %s\n", pkg)
+	imports, shared, err := sharedRuntime()
+	if err != nil {
+		return err
+	}
+	src.WriteString("\nimport (\n")
+	for _, path := range imports {
+		fmt.Fprintf(&src, "\t%q\n", path)
+	}
+	src.WriteString(")\n\n")
+	src.WriteString(shared)
+	src.WriteString(generatedParser)
+	fmt.Fprintf(&src, "\n// the rule which Parse begins with\nconst startRule = %q\n", start)
+
+	quoted := make([]string, len(order))
+	for i, name := range order {
+		quoted[i] = strconv.Quote(name)
+	}
+	fmt.Fprintf(&src, "\n// reports whether the grammar defines the named rule\n"+
+		"func defined(rule string) bool {\n"+
+		"\tswitch rule {\n\tcase %s:\n\t\treturn true\n\t}\n\treturn false\n}\n",
+		strings.Join(quoted, ", "))
+
+	src.WriteString("\n// parses the body of the named rule\n" +
+		"func (p *parser) run(rule string) (bool, *Cst) {\n\tswitch rule {\n")
+	for _, name := range order {
+		fmt.Fprintf(&src, "\tcase %q:\n\t\treturn p.rule_%s(%q)\n", name, name, name)
+	}
+	src.WriteString("\t}\n\treturn false, nil\n}\n")
+
+	for _, m := range gen.methods {
+		fmt.Fprintf(&src, "\n// %s = %s\nfunc (p *parser) %s(n string) (bool, *Cst) {\n%s}\n",
+			m.label, m.text, m.name, m.body)
+	}
+
+	formatted, err := format.Source(src.Bytes())
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(formatted)
+	return err
+}
+
+// the source of runtime.go, as compiled into the package
+//
+//go:embed runtime.go
+var runtimeSource string
+
+// returns the imports needed by a generated parser, and the declarations
+// of runtime.go, which follow its imports
+func sharedRuntime() ([]string, string, error) {
+	fset := gotoken.NewFileSet()
+	f, err := goparser.ParseFile(fset, "runtime.go", runtimeSource, goparser.ParseComments)
+	if err != nil {
+		return nil, "", err
+	}
+
+	imports := map[string]bool{}
+	for _, path := range generatedImports {
+		imports[path] = true
+	}
+	for _, spec := range f.Imports {
+		path, _ := strconv.Unquote(spec.Path.Value)
+		imports[path] = true
+	}
+	paths := []string{}
+	for path := range imports {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	// the comments between the imports and the first declaration are
+	// about this package, so they are left out
+	start := len(runtimeSource)
+	for _, decl := range f.Decls {
+		pos, doc := decl.Pos(), (*ast.CommentGroup)(nil)
+		switch d := decl.(type) {
+		case *ast.GenDecl:
+			if d.Tok == gotoken.IMPORT {
+				continue
+			}
+			doc = d.Doc
+		case *ast.FuncDecl:
+			doc = d.Doc
+		}
+		if doc != nil {
+			pos = doc.Pos()
+		}
+		start = fset.Position(pos).Offset
+		break
+	}
+	return paths, runtimeSource[start:], nil
+}
+
+// writes a method for each rule, and for each of the expressions within
+// a rule which is more than a single literal, wildcard, class or
+// reference. Those are matched by helpers of the runtime instead.
+type generator struct {
+	analysis *Analysis
+	methods  []method
+
+	// the rule being written, and the number of methods written for it
+	current string
+	count   int
+}
+
+type method struct {
+	name  string
+	label string // how the comment refers to the method
+	text  string // the shorthand it parses
+	body  string
+}
+
+// A call is the Go expression which parses a node of the shorthand,
+// given the Go expression for the name of the resulting Cst node.
+type call func(n string) string
+
+func (gen *generator) rule(name string) {
+	gen.current, gen.count = name, 0
+	tree := gen.analysis.trees[name]
+	before := len(gen.methods)
+
+	body := gen.expression(tree)
+
+	if len(gen.methods) > before {
+		// the method for the body of the rule is written last, after
+		// those it calls, and becomes the method of the rule
+		top := &gen.methods[len(gen.methods)-1]
+		top.name, top.label = "rule_"+name, name
+		return
+	}
+	gen.methods = append(gen.methods, method{
+		name:  "rule_" + name,
+		label: name,
+		text:  gen.text(tree),
+		body:  "\treturn " + body("n") + "\n",
+	})
+}
+
+// writes a method with the given body, which parses the given node. The
+// names of these never clash with those of rules, as the number after
+// the last underscore tells which rule they belong to.
+func (gen *generator) method(node *Cst, body string) call {
+	gen.count++
+	name := fmt.Sprintf("expr_%s_%d", gen.current, gen.count)
+	gen.methods = append(gen.methods, method{
+		name:  name,
+		label: name,
+		text:  gen.text(node),
+		body:  body,
+	})
+
+	return func(n string) string {
+		return fmt.Sprintf("p.%s(%s)", name, n)
+	}
+}
+
+// the shorthand of a node, fit for a line comment
+func (gen *generator) text(node *Cst) string {
+	return strings.NewReplacer("\n", `\n`, "\r", `\r`).Replace(shorthandText(node))
+}
+
+func (gen *generator) expression(node *Cst) call {
+	sequences := elements(node)
+	if len(sequences) == 1 {
+		return gen.sequence(sequences[0])
+	}
+
+	children := []call{}
+	for _, sequence := range sequences {
+		children = append(children, gen.sequence(sequence))
+	}
+
+	var body strings.Builder
+	body.WriteString("\tstart := p.pos\n")
+	for _, child := range children {
+		fmt.Fprintf(&body, "\tif ok, child := %s; ok {\n"+
+			"\t\treturn true, p.span(NewCst(choose(n, \"Or\"), []*Cst{child}), start)\n"+
+			"\t}\n"+
+			"\tp.pos = start\n", child(`""`))
+	}
+	body.WriteString("\treturn false, nil\n")
+	return gen.method(node, body.String())
+}
+
+func (gen *generator) sequence(node *Cst) call {
+	terms := elements(node)
+	if len(terms) == 1 {
+		return gen.prefixed(terms[0])
+	}
+
+	children := []call{}
+	for _, term := range terms {
+		children = append(children, gen.prefixed(term))
+	}
+
+	// a failing sequence is left at the start of the failing term, as
+	// And is, which matters only to the end recorded in the memo table
+	var body strings.Builder
+	body.WriteString("\tnode, begin := NewCst(choose(n, \"And\")), p.pos\n")
+	for _, child := range children {
+		fmt.Fprintf(&body, "\tif start := p.pos; !node.addMatch(%s) {\n"+
+			"\t\tp.pos = start\n"+
+			"\t\treturn false, nil\n"+
+			"\t}\n", child(`""`))
+	}
+	body.WriteString("\treturn true, p.span(node, begin)\n")
+	return gen.method(node, body.String())
+}
+
+func (gen *generator) prefixed(node *Cst) call {
+	parser := gen.term(node.nthChild(1))
+
+	// wrapped from the term outwards, as in prefixedToParser
+	predicates := node.nthChild(0).children
+
+	for i := len(predicates) - 1; i >= 0; i-- {
+		kind, fails := "Lookahead", "!ok"
+		if predicates[i].nthChild(0).value == "!" {
+			kind, fails = "Not", "ok"
+		}
+
+		parser = gen.method(node, fmt.Sprintf(
+			"\tstart, mark := p.pos, p.failure\n"+
+				"\tok, _ := %s\n"+
+				"\tp.pos, p.failure = start, mark\n"+
+				"\tif %s {\n\t\treturn false, nil\n\t}\n"+
+				"\treturn true, p.span(NewCst(choose(n, %q)), start)\n",
+			parser(`""`), fails, kind))
+	}
+	return parser
+}
+
+func (gen *generator) term(node *Cst) call {
+	parser := gen.component(node.nthChild(0))
+
+	for _, quantifier := range node.nthChild(1).children {
+		child := quantifier.nthChild(0)
+
+		switch child.value {
+		case "?":
+			parser = gen.optional(node, parser)
+		case "*":
+			parser = gen.many(node, parser)
+		case "+":
+			parser = gen.repeat(node, parser, "OneOrMore", 1, -1)
+		default:
+			min, max, _ := boundsOf(child, gen.analysis.compiled)
+			parser = gen.repeat(node, parser, "Repeat", min, max)
+		}
+	}
+
+	if recovery := node.nthChild(2); len(recovery.children) > 0 {
+		sync := gen.component(recovery.nthChild(0).nthChild(1))
+		parser = gen.recover(node, parser, sync)
+	}
+	return parser
+}
+
+func (gen *generator) component(node *Cst) call {
+	child := node.nthChild(0)
+	c := gen.analysis.compiled
+
+	switch child.typ {
+	case "literal":
+		chars, _ := literalChars(child, c)
+		args := []string{strconv.Quote(quote(strings.Join(chars, "")))}
+		for _, char := range chars {
+			args = append(args, strconv.Quote(char))
+		}
+		return func(n string) string {
+			return fmt.Sprintf("p.literal(%s, %s)", n, strings.Join(args, ", "))
+		}
+	case "wildcard":
+		chars, _ := literalChars(child.nthChild(1), c)
+		except := strings.Join(chars, "")
+		return func(n string) string {
+			return fmt.Sprintf("p.wildcard(%s, %q, %q)", n, except, describeWildcard(except))
+		}
+	case "class":
+		negated, ranges, _ := classRanges(child, c)
+		args := []string{strconv.FormatBool(negated), strconv.Quote(describeClass(negated, ranges))}
+		for _, rng := range ranges {
+			args = append(args, fmt.Sprintf("runeRange{%s, %s}",
+				strconv.QuoteRune(rng.Lo), strconv.QuoteRune(rng.Hi)))
+		}
+		return func(n string) string {
+			return fmt.Sprintf("p.class(%s, %s)", n, strings.Join(args, ", "))
+		}
+	case "reference":
+		// the node is named after the rule referred to
+		name := child.Text()
+		return func(string) string {
+			return fmt.Sprintf("p.apply(%q)", name)
+		}
+	case "end":
+		return func(n string) string {
+			return fmt.Sprintf("p.eof(%s)", n)
+		}
+	case "many":
+		return gen.many(child, gen.expression(child.nthChild(1)))
+	case "optional":
+		return gen.optional(child, gen.expression(child.nthChild(1)))
+	}
+	// a group, i.e. { expression }
+	return gen.expression(child.nthChild(1))
+}
+
+func (gen *generator) many(node *Cst, parser call) call {
+	return gen.method(node, fmt.Sprintf(
+		"\tnode, begin := NewCst(choose(n, \"Many\")), p.pos\n"+
+			"\tfor {\n"+
+			"\t\tstart := p.pos\n"+
+			"\t\tok, child := %s\n"+
+			"\t\tif !ok {\n\t\t\tp.pos = start\n\t\t\tbreak\n\t\t}\n"+
+			"\t\tif p.pos == start {\n\t\t\tbreak // as Many does\n\t\t}\n"+
+			"\t\tnode.addChild(child)\n"+
+			"\t}\n"+
+			"\treturn true, p.span(node, begin)\n",
+		parser(`""`)))
+}
+
+func (gen *generator) optional(node *Cst, parser call) call {
+	return gen.method(node, fmt.Sprintf(
+		"\tnode, start := NewCst(choose(n, \"Optional\")), p.pos\n"+
+			"\tif !node.addMatch(%s) {\n\t\tp.pos = start\n\t}\n"+
+			"\treturn true, p.span(node, start)\n",
+		parser(`""`)))
+}
+
+func (gen *generator) repeat(node *Cst, parser call, kind string, min int, max int) call {
+	loop := "for {"
+	if max >= 0 {
+		loop = fmt.Sprintf("for len(node.children) < %d {", max)
+	}
+	return gen.method(node, fmt.Sprintf(
+		"\tnode, begin := NewCst(choose(n, %q)), p.pos\n"+
+			"\t%s\n"+
+			"\t\tstart := p.pos\n"+
+			"\t\tif !node.addMatch(%s) {\n\t\t\tp.pos = start\n\t\t\tbreak\n\t\t}\n"+
+			"\t\tif p.pos == start && len(node.children) >= %d {\n\t\t\tbreak\n\t\t}\n"+
+			"\t}\n"+
+			"\tif len(node.children) < %d {\n\t\tp.pos = begin\n\t\treturn false, nil\n\t}\n"+
+			"\treturn true, p.span(node, begin)\n",
+		kind, loop, parser(`""`), min, min))
+}
+
+func (gen *generator) recover(node *Cst, parser call, sync call) call {
+	return gen.method(node, fmt.Sprintf(
+		"\tstart, mark := p.pos, p.failure\n"+
+			"\tp.failure = failure{pos: -1}\n"+
+			"\tif ok, node := %s; ok {\n\t\tp.failure.within(mark, p.failure)\n\t\treturn true, node\n\t}\n"+
+			"\tp.pos = start\n"+
+			"\tnode := NewCst(\"Error\")\n"+
+			"\tnode.err = p.failedAt(p.failure, p.pos, \"\")\n"+
+			"\tp.failure = mark\n"+
+			"\tp.skip(func() bool {\n\t\tok, _ := %s\n\t\treturn ok\n\t})\n"+
+			"\tnode.value = p.input[start:p.pos]\n"+
+			"\treturn true, p.span(node, start)\n",
+		parser("n"), sync(`""`)))
+}
+
+// the parser shared by every generated grammar, which runs the methods
+// written for its rules. Its trees and errors are those of runtime.go.
+var generatedImports = []string{"fmt", "strings", "unicode/utf8"}
+
+const generatedParser = `
+// parses the entire input with the first rule of the grammar
+func Parse(input string) (*Cst, error) {
+	return ParseRule(startRule, input)
+}
+
+// parses the entire input with the given rule, as the Parse method of
+// a compiled grammar does, partial trees and ParseErrors included
+func ParseRule(rule string, input string) (*Cst, error) {
+	if !defined(rule) {
+		return nil, fmt.Errorf("no rule %q", rule)
+	}
+
+	p := &parser{
+		source:  newSource(input),
+		memo:    map[memoKey]memoEntry{},
+		failure: failure{pos: -1},
+	}
+	matches, tree := p.apply(rule)
+
+	// as finish does in the parse package
+	if !matches {
+		return nil, p.failedAt(p.failure, p.pos, rule)
+	}
+	if done, _ := p.eof(""); !done {
+		return nil, p.failedAt(p.failure, p.pos, rule)
+	}
+
+	recovered := tree.Errors()
+	if len(recovered) == 0 {
+		return tree, nil
+	}
+
+	errs := ParseErrors{}
+	for _, err := range recovered {
+		err := *err
+		err.Rule = rule
+		errs = append(errs, &err)
+	}
+	return tree, errs
+}
+
+type parser struct {
+	*source
+	pos int
+
+	// the result of every rule by position
+	memo map[memoKey]memoEntry
+
+	// see failure
+	failure failure
+}
+
+type memoKey struct {
+	rule string
+	pos  int
+}
+
+type memoEntry struct {
+	matches bool
+	node    *Cst
+	end     int
+}
+
+type runeRange struct {
+	lo, hi rune
+}
+
+// runs the named rule, unless its result at this position is known
+func (p *parser) apply(rule string) (bool, *Cst) {
+	key := memoKey{rule, p.pos}
+
+	if m, ok := p.memo[key]; ok {
+		if !m.matches {
+			p.failure.expectAt(key.pos, rule)
+		}
+		p.pos = m.end
+		return m.matches, m.node
+	}
+
+	mark := p.failure
+	matches, node := p.run(rule)
+
+	if !matches {
+		// as in the apply of the parse package
+		p.failure.instead(mark, key.pos, rule)
+	}
+
+	p.memo[key] = memoEntry{matches, node, p.pos}
+	return matches, node
+}
+
+// as Lexer.span does in the parse package
+func (p *parser) span(node *Cst, start int) *Cst {
+	node.src = p.source
+	node.start = start
+	node.end = p.pos
+	return node
+}
+
+// adds the result of a parser to the node if it matched
+func (a *Cst) addMatch(matches bool, child *Cst) bool {
+	if matches {
+		a.addChild(child)
+	}
+	return matches
+}
+
+func choose(name string, dflt string) string {
+	if len(name) > 0 {
+		return name
+	}
+	return dflt
+}
+
+// matches each of the characters of a literal as a leaf of its own,
+// failing as a whole. As with And, a failure is left at the start of
+// the character which failed.
+func (p *parser) literal(n string, expected string, chars ...string) (bool, *Cst) {
+	node, begin := NewCst(choose(n, "And")), p.pos
+
+	for _, char := range chars {
+		if !strings.HasPrefix(p.input[p.pos:], char) {
+			p.failure.expectAt(begin, expected)
+			return false, nil
+		}
+		start := p.pos
+		p.pos += len(char)
+		node.addChild(p.span(NewLeaf("Is", char), start))
+	}
+	return true, p.span(node, begin)
+}
+
+func (p *parser) wildcard(n string, except string, expected string) (bool, *Cst) {
+	r, w := utf8.DecodeRuneInString(p.input[p.pos:])
+
+	if w == 0 || strings.ContainsRune(except, r) {
+		p.failure.expectAt(p.pos, expected)
+		return false, nil
+	}
+
+	start := p.pos
+	p.pos += w
+	return true, p.span(NewLeaf(choose(n, "Wildcard"), string(r)), start)
+}
+
+func (p *parser) class(n string, negated bool, expected string, ranges ...runeRange) (bool, *Cst) {
+	r, w := utf8.DecodeRuneInString(p.input[p.pos:])
+
+	in := false
+	for _, rng := range ranges {
+		if rng.lo <= r && r <= rng.hi {
+			in = true
+		}
+	}
+
+	if w == 0 || in == negated {
+		p.failure.expectAt(p.pos, expected)
+		return false, nil
+	}
+
+	start := p.pos
+	p.pos += w
+	return true, p.span(NewLeaf(choose(n, "Class"), string(r)), start)
+}
+
+func (p *parser) eof(n string) (bool, *Cst) {
+	if p.pos < len(p.input) {
+		p.failure.expectAt(p.pos, "end of input")
+		return false, nil
+	}
+	return true, p.span(NewCst(choose(n, "EOF")), p.pos)
+}
+
+// skips input as skip does in the parse package, for Recover
+func (p *parser) skip(sync func() bool) {
+	mark := p.failure
+	defer func() { p.failure = mark }()
+
+	for {
+		start := p.pos
+		if sync() {
+			return
+		}
+		p.pos = start
+
+		_, w := utf8.DecodeRuneInString(p.input[p.pos:])
+		if w == 0 {
+			return
+		}
+		p.pos += w
+	}
+}
+`
@@ -0,0 +1,109 @@
+package parse
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+)
+
+/////////////////////// Grammar Files ////////////////////////
+
+/*
+	A Grammar written in Go must be compiled into the binary, and a
+	map has no order, so there is no telling which of its rules comes
+	first. Grammars may instead be read from text, such as a .peg file
+	kept next to its test inputs, in which each rule is declared as
+
+		name = expression ;
+
+	where the expression is written in the shorthand. Comments may be
+	placed anywhere outside of literals and classes, as in the
+	shorthand itself, and are kept as part of the text of each rule.
+*/
+
+// A GrammarFile is a Grammar read from text, which remembers the order
+// in which its rules were declared.
+type GrammarFile struct {
+	Grammar
+	Order []string // names of the rules, in the order declared
+}
+
+// returns the first rule declared, which is the rule to parse with
+// unless told otherwise
+func (f *GrammarFile) Start() string {
+	if len(f.Order) == 0 {
+		return ""
+	}
+	return f.Order[0]
+}
+
+// reads a grammar in the format described above, returning a
+// *ParseError if the text isn't a list of declarations. The rules
+// themselves are only checked once the grammar is compiled.
+func ParseGrammarFile(r io.Reader) (*GrammarFile, error) {
+	text, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	tree, err := StringParser(grammarFile)(string(text))
+	if err != nil {
+		return nil, err
+	}
+
+	f := &GrammarFile{Grammar{}, []string{}}
+
+	for _, decl := range tree.nthChild(1).children {
+		name := decl.nthChild(0).Text()
+
+		if f.has(name) {
+			return nil, &ParseError{
+				Position: decl.Span().Start,
+				Found:    strconv.Quote(name),
+				Err:      fmt.Errorf("rule %q is declared twice", name),
+			}
+		}
+		f.Grammar[name] = decl.nthChild(3).Text()
+		f.Order = append(f.Order, name)
+	}
+	return f, nil
+}
+
+// file -> blank & [ declaration ] & $
+// declaration -> reference & blank & = & body & ; & blank
+// body -> [ literal | class | comment | *';\'<' ]
+// blank -> [ < \t\n\r> | comment ]
+// comment -> { # | // } & [*'\n'] | /* & [ !*/ & *'' ] & */
+
+func grammarFile(l *Lexer, n ...string) (bool, *Cst) {
+	return And(blank, Many(declaration), EOF())(l, "file")
+}
+
+func declaration(l *Lexer, n ...string) (bool, *Cst) {
+	return And(
+		reference,
+		blank,
+		Is("="),
+		body,
+		Is(";"),
+		blank,
+	)(l, "declaration")
+}
+
+// the text of a rule, which runs to the first ; outside of a literal,
+// class or comment
+func body(l *Lexer, n ...string) (bool, *Cst) {
+	return Many(Or(literal, class, comment, Wildcard(`;'<`)))(l, "body")
+}
+
+func blank(l *Lexer, n ...string) (bool, *Cst) {
+	space := Class(false, RuneRange{' ', ' '}, RuneRange{'\t', '\n'}, RuneRange{'\r', '\r'})
+	return Many(Or(space, comment))(l, "blank")
+}
+
+func comment(l *Lexer, n ...string) (bool, *Cst) {
+	return Or(
+		And(Or(Is("#"), Is("//")), Many(Wildcard("\n"))),
+		And(Is("/*"), Many(And(Not(Is("*/")), Wildcard(""))), Is("*/")),
+	)(l, "comment")
+}
@@ -0,0 +1,209 @@
+package parse
+
+import (
+	"github.com/stretchr/testify/assert"
+	"os"
+	"strings"
+	"testing"
+)
+
+// the json grammar from the example in main.go, which is kept in
+// testdata/json.peg, and the glossary input that timef parses
+func readJSON(t testing.TB) *GrammarFile {
+	file, err := os.Open("testdata/json.peg")
+	assert.NoError(t, err)
+	defer file.Close()
+
+	f, err := ParseGrammarFile(file)
+	assert.NoError(t, err)
+	return f
+}
+
+var glossary = `{
+	"glossary": {
+		"title": "example glossary",
+		"GlossDiv": {
+			"title": "S",
+			"GlossList": {
+				"GlossEntry": {
+					"ID": "SGML",
+					"SortAs": "SGML",
+					"GlossTerm": "Standard Generalized Markup Language",
+					"Acronym": "SGML",
+					"Abbrev": "ISO 8879:1986",
+					"GlossDef": {
+						"para": "A meta-markup language, used to create markup languages such as DocBook.",
+						"GlossSeeAlso": ["GML", "XML"]
+					},
+					"GlossSee": "markup"
+				}
+			}
+		}
+	}
+}`
+
+func compileJSON(t testing.TB) Parser {
+	compiled, err := readJSON(t).Compile()
+	assert.NoError(t, err)
+
+	p, err := compiled.GetParser("object")
+	assert.NoError(t, err)
+	return p
+}
+
+func TestJSON_Glossary(t *testing.T) {
+	matches, _, l := SetUp(compileJSON(t), glossary)
+
+	assert.True(t, matches)
+	assert.True(t, l.Done())
+}
+
+func TestJSON_Untracked(t *testing.T) {
+	matches, _, l := SetUp(compileJSON(t), glossary)
+
+	assert.True(t, matches)
+	assert.Nil(t, l.calls, "Rules which aren't left recursive needn't be tracked")
+}
+
+func TestJSON_Escapes(t *testing.T) {
+	matches, _, l := SetUp(compileJSON(t), `{"a": "say \"hi\"\n\u00e9"}`)
+
+	assert.True(t, matches)
+	assert.True(t, l.Done())
+}
+
+func TestJSON_Error(t *testing.T) {
+	g := Compile(t, readJSON(t).Grammar)
+
+	_, err := g.Parse("object", "{\n\t\"a\": 1,\n\t\"b\": 2 x\n}")
+
+	var perr *ParseError
+	assert.ErrorAs(t, err, &perr)
+	assert.Equal(t, perr.Position, Position{19, 3, 9})
+	assert.Equal(t, perr.Expected, []string{`< \t\n\r>`, "','", "'}'"})
+	assert.Equal(t, err.Error(), `parsing "object": line 3 col 9: expected < \t\n\r>, ',' or '}', found 'x'`)
+}
+
+func TestJSON_ErrorPackrat(t *testing.T) {
+	p := compileJSON(t)
+
+	l := NewLexer(`{"a": [1, 2,]}`)
+	l.EnablePackrat()
+	matches, _ := p(l)
+
+	assert.False(t, matches)
+	assert.Equal(t, newParseError(l, "").Error(), "line 1 col 13: expected elements, found ']'")
+}
+
+func TestJSON_GrammarFile(t *testing.T) {
+	f := readJSON(t)
+
+	assert.Equal(t, f.Start(), "object")
+	assert.Len(t, f.Order, 19)
+	assert.Equal(t, f.Rule("members"), "{pair&','&members}|pair")
+	assert.Equal(t, f.Rule("ws"), "[< \\t\\n\\r>]")
+	assert.Equal(t, f.Rule("otn"), "<1-9>", "Comments should be stripped")
+}
+
+func TestJSON_Generate(t *testing.T) {
+	f := readJSON(t)
+
+	inputs := []string{glossary, `{"a": [1, 2.5e3, {}]}`, `{"a": tru}`, `{"a" 1}`}
+	actual, expected := generatedResults(t, f.Grammar, f.Start(), inputs)
+
+	assert.Equal(t, actual, expected)
+
+	var src strings.Builder
+	assert.NoError(t, f.Generate(&src, "json"))
+	assert.Contains(t, src.String(), `const startRule = "object"`)
+	assert.Less(t, strings.Index(src.String(), "rule_object("), strings.Index(src.String(), "rule_members("),
+		"Methods should be in the order the rules were declared")
+}
+
+func TestJSON_Program(t *testing.T) {
+	assertSameResults(t, readJSON(t).Grammar, "object", []string{
+		glossary, `{"a": [1, 2.5e3, {}]}`, `{"a": tru}`, `{"a" 1}`,
+	})
+}
+
+func TestJSON_ProgramBinary(t *testing.T) {
+	p, err := readJSON(t).CompileProgram()
+	assert.NoError(t, err)
+	data, err := p.MarshalBinary()
+	assert.NoError(t, err)
+
+	var q Program
+	assert.NoError(t, q.UnmarshalBinary(data))
+	assert.Equal(t, q.rules, p.rules, "No rule should be taken for left recursive when it's read")
+}
+
+func TestJSON_PackratSameTree(t *testing.T) {
+	p := compileJSON(t)
+	input := glossary
+
+	_, tree, _ := SetUp(p, input)
+
+	l := NewLexer(input)
+	l.EnablePackrat()
+	matches, memoTree := p(l)
+
+	assert.True(t, matches)
+	assert.True(t, l.Done())
+	assert.Equal(t, memoTree.String(), tree.String())
+}
+
+func TestPackrat_Reset(t *testing.T) {
+	p := compileJSON(t)
+
+	l := NewLexer(`{"a":1}`)
+	l.EnablePackrat()
+	matches, _ := p(l)
+	assert.True(t, matches)
+
+	l.Reset()
+	matches, tree := p(l)
+	assert.True(t, matches)
+	assert.Equal(t, tree.Text(), `{"a":1}`)
+}
+
+func benchmarkJSON(b *testing.B, packrat bool) {
+	benchmarkParser(b, compileJSON(b), packrat)
+}
+
+func benchmarkParser(b *testing.B, p Parser, packrat bool) {
+	l := NewLexer(glossary)
+	if packrat {
+		l.EnablePackrat()
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		l.Reset()
+		_, _ = p(l)
+	}
+}
+
+func BenchmarkJSON_Backtracking(b *testing.B) {
+	benchmarkJSON(b, false)
+}
+
+func BenchmarkJSON_Packrat(b *testing.B) {
+	benchmarkJSON(b, true)
+}
+
+// the same as benchmarkJSON, with the grammar compiled to a program
+func benchmarkProgram(b *testing.B, packrat bool) {
+	program, err := readJSON(b).CompileProgram()
+	assert.NoError(b, err)
+
+	p, _ := program.GetParser("object")
+	benchmarkParser(b, p, packrat)
+}
+
+func BenchmarkJSON_ProgramBacktracking(b *testing.B) {
+	benchmarkProgram(b, false)
+}
+
+func BenchmarkJSON_ProgramPackrat(b *testing.B) {
+	benchmarkProgram(b, true)
+}
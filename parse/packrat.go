@@ -0,0 +1,141 @@
+package parse
+
+/////////////////////// Packrat Parsing & Left Recursion ////////////////////////
+
+/*
+	Ordered choice rewinds the lexer whenever an alternative fails, so
+	a rule may be parsed from the same position many times over. e.g.
+	the json 'number' rule parses 'int' up to four times:
+
+		{ int & frac & exp } | { int & frac } | { int & exp } | int
+
+	When packrat parsing is enabled on a Lexer, the result of every
+	rule of a CompiledGrammar is remembered by position, so each rule
+	is parsed at most once per position and parsing takes time linear
+	in the length of the input (at the cost of memory of the same).
+*/
+
+type memoKey struct {
+	grammar ruleSet
+	rule    string
+	pos     int
+}
+
+// A ruleSet runs the bodies of the rules of a grammar, whether as the
+// closures of a CompiledGrammar or the code of a Program
+type ruleSet interface {
+	run(s string, l *Lexer) (bool, *Cst)
+
+	// whether the rule may call itself before consuming input
+	leftRecursive(s string) bool
+}
+
+type memoEntry struct {
+	matches bool
+	node    *Cst
+	end     int
+}
+
+// enables memoization of the rules of compiled grammars
+func (l *Lexer) EnablePackrat() {
+	if l.memo == nil {
+		l.memo = map[memoKey]memoEntry{}
+	}
+}
+
+// moves the lexer to the given position, forwards or backwards
+func (l *Lexer) moveTo(n int) {
+	if n > l.pos() {
+		l.advance(n - l.pos())
+	} else {
+		l.scanTo(n)
+	}
+}
+
+/*
+	A rule which calls itself without consuming input, i.e.
+
+		expr -> { expr & '+' & term } | term
+
+	would recurse forever. Instead, each call of a rule at a position
+	is tracked while it is in progress. If the rule is reentered at
+	the same position, the inner call is answered with a 'seed' (at
+	first, failure), which forces the rule onto one of its other
+	alternatives. The outer call then reparses the rule with the
+	seed set to its previous match, growing the match for as long as
+	it gets longer. The same works for indirect left recursion, as the
+	rules in between are parsed anew while the seed grows.
+*/
+
+type invocation struct {
+	seed memoEntry // the longest match found so far
+	hits int       // the number of times the seed has been used
+}
+
+// runs the parser for the named rule, consulting the memo table of
+// the lexer if packrat parsing is enabled
+func apply(c ruleSet, s string, l *Lexer) (bool, *Cst) {
+	if l.memo == nil && !c.leftRecursive(s) {
+		// there is nothing to remember, and no seed to grow, as
+		// only a left recursive rule can be reentered here
+		start, mark := l.pos(), l.failure
+		matches, node := c.run(s, l)
+		if !matches {
+			l.expectInstead(mark, start, s)
+		}
+		return matches, node
+	}
+
+	key := memoKey{c, s, l.pos()}
+
+	if call, ok := l.calls[key]; ok {
+		// left recursion, answer with the seed
+		call.hits++
+		l.recursions++
+		l.moveTo(call.seed.end)
+		return call.seed.matches, call.seed.node
+	}
+
+	if m, ok := l.memo[key]; ok {
+		if !m.matches {
+			l.expectAt(key.pos, s)
+		}
+		l.moveTo(m.end)
+		return m.matches, m.node
+	}
+
+	if l.calls == nil {
+		l.calls = map[memoKey]*invocation{}
+	}
+	call := &invocation{seed: memoEntry{false, nil, key.pos}}
+	l.calls[key] = call
+	recursions := l.recursions
+	mark := l.failure
+
+	matches, node := c.run(s, l)
+
+	if call.hits > 0 {
+		// grow the seed until the rule stops matching more input
+		for matches && (!call.seed.matches || l.pos() > call.seed.end) {
+			call.seed = memoEntry{matches, node, l.pos()}
+			l.moveTo(key.pos)
+			matches, node = c.run(s, l)
+		}
+		matches, node = call.seed.matches, call.seed.node
+		l.moveTo(call.seed.end)
+	}
+	delete(l.calls, key)
+
+	if !matches {
+		// a rule which fails where it started is expected by name
+		l.expectInstead(mark, key.pos, s)
+	}
+
+	// a result which depends on the seed of some other rule is only
+	// provisional, as that rule is still growing
+	if l.memo != nil && l.recursions-recursions == call.hits {
+		l.memo[key] = memoEntry{matches, node, l.pos()}
+	}
+
+	return matches, node
+}
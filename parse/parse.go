@@ -1,7 +1,6 @@
 package parse
 
 import (
-	"fmt"
 	"reflect"
 	"runtime"
 	"strings"
@@ -28,25 +27,6 @@ func nameOf(i interface{}) string {
 	return name[prefixOffset:]
 }
 
-func (t Cst) String() string {
-	output := t.typ
-
-	if len(t.value) > 0 {
-		output += "<" + t.value + ">"
-	}
-
-	childRepr := ""
-	for _, child := range t.children {
-		childRepr += ", " + child.String()
-	}
-
-	if len(childRepr) > 0 {
-		output += "(" + childRepr[2:] + ")"
-	}
-
-	return output
-}
-
 func RmWhiteSpace(s string) string {
 	s = strings.Replace(s, " ", "", -1)
 	s = strings.Replace(s, "\n", "", -1)
@@ -80,8 +60,23 @@ type Parser func(*Lexer, ...string) (bool, *Cst)
 type ParserCombinator func(...Parser) Parser
 
 type Lexer struct {
-	input    string
+	*source
 	position int
+
+	// results of rules by position, when packrat parsing is enabled
+	memo map[memoKey]memoEntry
+
+	// rules in progress by position, for detecting left recursion
+	calls      map[memoKey]*invocation
+	recursions int
+
+	// the furthest error returned by an action, see Map, and the end
+	// of the match it was given
+	actionErr *ParseError
+	actionEnd int
+
+	// the furthest position at which a parser failed to match
+	failure failure
 }
 
 var UpCounter int
@@ -105,6 +100,11 @@ func (l *Lexer) pos() int {
 	return l.position
 }
 
+// returns the current position of the lexer within its input
+func (l *Lexer) Position() Position {
+	return l.locate(l.pos())
+}
+
 func (l *Lexer) peek(n int) string {
 	return l.input[l.position : l.position+n]
 }
@@ -135,42 +135,42 @@ func (l *Lexer) peekNextRune() (rune, int) {
 
 func (l *Lexer) Reset() {
 	l.position = 0
+	l.actionErr = nil
+	l.failure = failure{pos: -1}
+	if l.memo != nil {
+		l.memo = map[memoKey]memoEntry{}
+	}
 }
 
 func NewLexer(s string) *Lexer {
-	return &Lexer{s, 0}
-}
-
-type Cst struct {
-	typ      string
-	children []*Cst
-	value    string
-}
-
-func NewCst(name string, optionalChildren ...[]*Cst) *Cst {
-	newAst := &Cst{
-		typ:      name,
-		children: []*Cst{},
-	}
-	if len(optionalChildren) == 1 {
-		newAst.children = optionalChildren[0]
-	}
-	return newAst
+	return &Lexer{source: newSource(s), failure: failure{pos: -1}}
 }
 
-func (a *Cst) addChild(child *Cst) {
-	a.children = append(a.children, child)
+// records the input consumed since start as the span of the node
+func (l *Lexer) span(node *Cst, start int) *Cst {
+	node.src = l.source
+	node.start = start
+	node.end = l.pos()
+	return node
 }
 
 func (a *Cst) nthChild(n int) *Cst {
 	return a.children[n]
 }
 
+// returns the value computed from the node by an action, if any
+func (a *Cst) Result() interface{} {
+	return a.result
+}
+
 // matches if the input string equals the given literal
 func Is(literal string) Parser {
+	expected := quote(literal)
+
 	return func(l *Lexer, n ...string) (bool, *Cst) {
 		// string is too short, fail
 		if len(literal) > l.left() {
+			l.expect(expected)
 			return false, nil
 		}
 
@@ -181,11 +181,13 @@ func Is(literal string) Parser {
 			node := NewCst(name)
 			node.value = literal
 
+			start := l.pos()
 			l.advance(len(literal)) // is a match, shorten string
 
-			return true, node
+			return true, l.span(node, start)
 		} else {
 			// not a match, fail
+			l.expect(expected)
 			return false, nil
 		}
 	}
@@ -193,6 +195,8 @@ func Is(literal string) Parser {
 
 // matches if the input string equals the given literal
 func Wildcard(except string) Parser {
+	expected := describeWildcard(except)
+
 	return func(l *Lexer, n ...string) (bool, *Cst) {
 		name := chooseName(n, nameOf(Wildcard))
 		node := NewCst(name)
@@ -202,14 +206,54 @@ func Wildcard(except string) Parser {
 		// fmt.Println(r, w, strings.ContainsRune(except, r))
 
 		if w == 0 || strings.ContainsRune(except, r) {
+			l.expect(expected)
 			return false, nil
 		} else {
 			node.value = string(r)
+
+			start := l.pos()
 			l.advance(w)
 
-			return true, node
+			return true, l.span(node, start)
+		}
+	}
+}
+
+// A RuneRange is an inclusive range of runes, as matched by Class.
+type RuneRange struct {
+	Lo, Hi rune
+}
+
+// matches a single rune within any of the given ranges, or when
+// negated, a single rune outside all of them
+func Class(negated bool, ranges ...RuneRange) Parser {
+	expected := describeClass(negated, ranges)
+
+	return func(l *Lexer, n ...string) (bool, *Cst) {
+		r, w := l.peekNextRune()
+
+		if w == 0 || inRanges(r, ranges) == negated {
+			l.expect(expected)
+			return false, nil
+		}
+
+		name := chooseName(n, nameOf(Class))
+		node := NewLeaf(name, string(r))
+
+		start := l.pos()
+		l.advance(w)
+
+		return true, l.span(node, start)
+	}
+}
+
+func inRanges(r rune, ranges []RuneRange) bool {
+	for _, rng := range ranges {
+		if rng.Lo <= r && r <= rng.Hi {
+			return true
 		}
 	}
+	return false
 }
 
 // matches if any one of the given parsers match
@@ -227,7 +271,7 @@ func Or(parsers ...Parser) Parser {
 				// tree.typ = nameOf(parser)
 				node.addChild(child)
 				// returns once first parser matches, skips rest
-				return true, node
+				return true, l.span(node, start)
 			} else {
 				l.scanTo(start)
 			}
@@ -247,6 +291,8 @@ func And(parsers ...Parser) Parser {
 		var matches bool
 		var child *Cst
 
+		begin := l.pos()
+
 		for _, parser := range parsers {
 			// test each test, sequentially - i.e. the remainder
 			// from the first test is given to the second test, etc
@@ -265,7 +311,7 @@ func And(parsers ...Parser) Parser {
 			}
 		}
 		// no test failed, match - return the final remainder
-		return true, node
+		return true, l.span(node, begin)
 	}
 }
 
@@ -283,22 +329,31 @@ func Many(parser Parser) Parser {
 		var child *Cst
 
 		matches = true
+		begin := l.pos()
 
 		// keeps iterating until the given parser no longer matches
-		// feed the remainder forward so that it chomps as it goes
-		for matches && l.left() > 0 {
+		// feed the remainder forward so that it chomps as it goes.
+		// The parser is tried even at the end of the input, so that
+		// what it expected there is recorded, e.g. the digit which
+		// may follow "1+(1+1". As the end no longer stops the loop, a
+		// parser which matches nothing stops it instead, and its
+		// empty match is left out, as it would repeat forever (see
+		// ErrNullableRepetition)
+		for matches {
 			start := l.pos()
 			matches, child = parser(l)
 
-			if matches {
-				node.addChild(child)
-			} else {
+			if !matches {
 				l.scanTo(start)
+			} else if l.pos() == start {
+				break // matching nothing would repeat forever
+			} else {
+				node.addChild(child)
 			}
 		}
 
 		// return whatever remains in the string
-		return true, node
+		return true, l.span(node, begin)
 	}
 }
 
@@ -313,56 +368,251 @@ func Optional(parser Parser) Parser {
 
 		if matches {
 			node.addChild(child)
-			return true, node
 		} else {
 			l.scanTo(start)
-			return true, node
 		}
+		return true, l.span(node, start)
 	}
 }
 
-// // matches [1...] instances of the given parser
-func OneOrMore(parser Parser) Parser {
-	return And(
-		parser,       // mandatory match
-		Many(parser), // 0 or  subsequent matches
-	)
+// matches only if the given parser does not, without consuming input
+func Not(parser Parser) Parser {
+	return func(l *Lexer, n ...string) (bool, *Cst) {
+		start := l.pos()
+		mark := l.failure
+		matches, _ := parser(l)
+		l.scanTo(start)
+		l.failure = mark // what the predicate looked for isn't expected
+
+		if matches {
+			return false, nil
+		}
+		name := chooseName(n, nameOf(Not))
+		return true, l.span(NewCst(name), start)
+	}
 }
 
-func StringParser(p Parser) func(string) (bool, *Cst) {
-	return func(s string) (bool, *Cst) {
-		l := NewLexer(s)
+// matches only if the given parser does, without consuming input
+func Lookahead(parser Parser) Parser {
+	return func(l *Lexer, n ...string) (bool, *Cst) {
+		start := l.pos()
+		mark := l.failure
+		matches, _ := parser(l)
+		l.scanTo(start)
+		l.failure = mark // what the predicate looked for isn't expected
 
-		matches, tree := p(l)
+		if !matches {
+			return false, nil
+		}
+		name := chooseName(n, nameOf(Lookahead))
+		return true, l.span(NewCst(name), start)
+	}
+}
 
-		if matches && l.left() == 0 {
-			return true, tree
-		} else {
-			fmt.Println("Remainder:", l.remainder()) // l.chomp(l.left()))
+// An Action computes a value, such as a number or a map, from a node
+type Action func(*Cst) (interface{}, error)
+
+// matches the given parser, then computes a value from the resulting
+// node with the given action. The value is available from Result. If
+// the action returns an error, the match fails.
+func Map(parser Parser, f Action) Parser {
+	return func(l *Lexer, n ...string) (bool, *Cst) {
+		start := l.pos()
+		matches, node := parser(l, n...)
+
+		if !matches {
 			return false, nil
 		}
+		return runAction(l, start, node, f)
+	}
+}
+
+func runAction(l *Lexer, start int, node *Cst, f Action) (bool, *Cst) {
+	result, err := f(node)
+
+	if err != nil {
+		if l.actionErr == nil || start >= l.actionErr.Offset {
+			l.actionEnd = l.pos()
+			l.actionErr = &ParseError{
+				Position: l.locate(start),
+				Found:    node.Text(),
+				Err:      err,
+			}
+		}
+		l.scanTo(start)
+		return false, nil
 	}
+
+	node.result = result
+	return true, node
 }
 
-func Test() {
-	// fmt.Println(StringParser(
-	// 	Many(Is("a")),
-	// )(`aa`))
+/*
+	Normally, the first failure aborts the whole parse. Recover marks
+	a point from which parsing may carry on regardless: if the given
+	parser fails, the input is skipped up to and including the next
+	match of sync (or to the end of the input), and an "Error" node is
+	matched in its place. The node holds the error which would have
+	been reported, so a tree containing it is a partial tree, e.g.
+
+		Many(Recover(statement, Is(";")))("x;?;y;")
+
+	matches three statements, the second of which is an Error node.
+	A sync parser which shouldn't consume its match, such as the '}'
+	closing a block, can be wrapped in Lookahead.
+*/
+
+// matches the given parser, or when it fails, skips to sync
+func Recover(parser Parser, sync Parser) Parser {
+	return func(l *Lexer, n ...string) (bool, *Cst) {
+		start := l.pos()
+
+		// only failures within the region are part of its error
+		mark := l.failure
+		actionErr, actionEnd := l.actionErr, l.actionEnd
+		l.failure = failure{pos: -1}
+		l.actionErr = nil
+
+		matches, node := parser(l, n...)
+
+		if !matches {
+			l.scanTo(start)
+			node = NewCst("Error")
+			node.err = newParseError(l, "")
+		}
+
+		inner, innerErr, innerEnd := l.failure, l.actionErr, l.actionEnd
+		l.failure = mark
+		l.actionErr, l.actionEnd = actionErr, actionEnd
 
-	// Many(And(literal, or))
+		if !matches {
+			skip(l, sync)
+			node.value = l.input[start:l.pos()]
+			return true, l.span(node, start)
+		}
+
+		// the region parsed, so whatever it expected still counts
+		l.expectWithin(mark, inner)
+		if innerErr != nil && (actionErr == nil || innerErr.Offset >= actionErr.Offset) {
+			l.actionErr, l.actionEnd = innerErr, innerEnd
+		}
+		return true, node
+	}
+}
 
-	// matches, _ := StringParser(
-	// 	Or(
-	// 		Many(And(Or(Is("x"), literal), or)),
-	// 		Many(And(literal, or)),
-	// 	),
-	// )(`'0'|'1'|'2'|'3'|x|'5'|'6'|'7'|'8'|'9'|`)
+// advances the lexer past the next match of sync, or to the end of the
+// input, without recording what sync expected
+func skip(l *Lexer, sync Parser) {
+	mark := l.failure
+	defer func() { l.failure = mark }()
 
-	matches, _ := StringParser(
-		expression,
-	)(`'0'`)
+	for {
+		start := l.pos()
+		if matches, _ := sync(l); matches {
+			return
+		}
+		l.scanTo(start)
 
-	fmt.Println(matches)
-	// fmt.Println(StringParser(Is("test"))("test"))
-	// fmt.Println(StringParser(Is("a"))("b"))
+		_, w := l.peekNextRune()
+		if w == 0 {
+			return
+		}
+		l.advance(w)
+	}
+}
+
+// matches only at the end of the input, without consuming anything
+func EOF() Parser {
+	return func(l *Lexer, n ...string) (bool, *Cst) {
+		if l.left() > 0 {
+			l.expect("end of input")
+			return false, nil
+		}
+		name := chooseName(n, nameOf(EOF))
+		return true, l.span(NewCst(name), l.pos())
+	}
+}
+
+// matches [1...] instances of the given parser
+func OneOrMore(parser Parser) Parser {
+	return func(l *Lexer, n ...string) (bool, *Cst) {
+		name := chooseName(n, nameOf(OneOrMore))
+		return repeat(l, parser, 1, -1, name)
+	}
+}
+
+// matches [min...max] instances of the given parser, or [min...]
+// instances when max is negative. i.e.
+//
+//	Repeat(Is("a"), 2, 3)("aaaa") ==> (true, "a")
+func Repeat(parser Parser, min int, max int) Parser {
+	return func(l *Lexer, n ...string) (bool, *Cst) {
+		name := chooseName(n, nameOf(Repeat))
+		return repeat(l, parser, min, max, name)
+	}
+}
+
+func repeat(l *Lexer, parser Parser, min int, max int, name string) (bool, *Cst) {
+	node := NewCst(name)
+	begin := l.pos()
+
+	for max < 0 || len(node.children) < max {
+		start := l.pos()
+		matches, child := parser(l)
+
+		if !matches {
+			l.scanTo(start)
+			break
+		}
+		node.addChild(child)
+
+		// a match which consumes nothing will only ever repeat, so
+		// there is no point in trying again once min is reached
+		if l.pos() == start && len(node.children) >= min {
+			break
+		}
+	}
+
+	if len(node.children) < min {
+		l.scanTo(begin)
+		return false, nil
+	}
+	return true, l.span(node, begin)
+}
+
+// matches the entire input string with the given parser
+func StringParser(p Parser) func(string) (*Cst, error) {
+	return func(s string) (*Cst, error) {
+		l := NewLexer(s)
+
+		matches, tree := p(l)
+
+		return finish(l, matches, tree, "")
+	}
+}
+
+// checks that a match consumed the entire input. If errors were
+// recovered from along the way, the partial tree is returned along
+// with ParseErrors listing them.
+func finish(l *Lexer, matches bool, tree *Cst, rule string) (*Cst, error) {
+	// whatever matched should have been followed by nothing
+	if !matches {
+		return nil, newParseError(l, rule)
+	}
+	if done, _ := EOF()(l); !done {
+		return nil, newParseError(l, rule)
+	}
+
+	recovered := tree.Errors()
+	if len(recovered) == 0 {
+		return tree, nil
+	}
+
+	errs := ParseErrors{}
+	for _, err := range recovered {
+		err := *err
+		err.Rule = rule
+		errs = append(errs, &err)
+	}
+	return tree, errs
 }
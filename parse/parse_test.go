@@ -1,13 +1,20 @@
 package parse
 
 import (
-	// "fmt"
+	"bytes"
+	"errors"
+	"fmt"
 	"github.com/stretchr/testify/assert"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
 )
 
-func SetUp(p Parser, s string) (bool, *Cst, *lexer) {
-	l := newLexer(s)
+func SetUp(p Parser, s string) (bool, *Cst, *Lexer) {
+	l := NewLexer(s)
 
 	matches, tree := p(l)
 
@@ -32,7 +39,6 @@ func TestIs_NoMatch(t *testing.T) {
 	assert.Equal(t, l.pos(), 0)
 }
 
-//
 func TestIs_PrefixMatch(t *testing.T) {
 	lit := "test"
 
@@ -123,6 +129,22 @@ func TestMany_Wrong(t *testing.T) {
 	assert.Equal(t, l.pos(), 0)
 }
 
+func TestMany_ExpectedAtEnd(t *testing.T) {
+	_, _, l := SetUp(Many(Is("a")), "aa")
+
+	// the parser is tried at the end of the input too, so that what
+	// could have followed is known
+	assert.Equal(t, newParseError(l, "").Error(), "line 1 col 3: expected 'a', found end of input")
+}
+
+func TestMany_EmptyMatch(t *testing.T) {
+	matches, tree, l := SetUp(Many(Optional(Is("a"))), "aab")
+
+	assert.True(t, matches, "Many should stop at a parser which matches nothing")
+	assert.Equal(t, l.pos(), 2)
+	assert.Len(t, tree.Children(), 2, "The empty match shouldn't be repeated")
+}
+
 /*
 	Optional() Edge cases
 */
@@ -147,3 +169,1484 @@ func TestOptional_Wrong(t *testing.T) {
 	assert.True(t, matches, "Optional should match wrong without advancing")
 	assert.Equal(t, l.pos(), 0)
 }
+
+/*
+	Compiled grammars
+*/
+
+func Compile(t *testing.T, g Grammar) *CompiledGrammar {
+	compiled, err := g.Compile()
+	assert.NoError(t, err)
+	return compiled
+}
+
+func CompileLeftRecursive(t *testing.T, g Grammar) *CompiledGrammar {
+	compiled, err := g.CompileLeftRecursive()
+	assert.NoError(t, err)
+	return compiled
+}
+
+func GetParser(t *testing.T, c *CompiledGrammar, rule string) Parser {
+	p, err := c.GetParser(rule)
+	assert.NoError(t, err)
+	return p
+}
+
+func TestCompile_Isolated(t *testing.T) {
+	ones := Compile(t, Grammar{"digit": "'1'"})
+	twos := Compile(t, Grammar{"digit": "'2'"})
+
+	matches, _, _ := SetUp(GetParser(t, ones, "digit"), "1")
+	assert.True(t, matches, "First grammar should use its own rule")
+
+	matches, _, _ = SetUp(GetParser(t, twos, "digit"), "2")
+	assert.True(t, matches, "Second grammar should use its own rule")
+
+	matches, _, _ = SetUp(GetParser(t, twos, "digit"), "1")
+	assert.False(t, matches, "Grammars shouldn't share rules")
+}
+
+func TestCompile_Recursive(t *testing.T) {
+	g := Compile(t, Grammar{"as": "{ 'a' & as } | 'a'"})
+
+	matches, _, l := SetUp(GetParser(t, g, "as"), "aaa")
+
+	assert.True(t, matches, "Recursive rules should match")
+	assert.Equal(t, l.pos(), 3)
+}
+
+/*
+	Errors
+*/
+
+func TestCompile_InvalidRule(t *testing.T) {
+	_, err := Grammar{"x": "'a' & 'b' ]"}.Compile()
+
+	var gerr *GrammarError
+	assert.ErrorAs(t, err, &gerr)
+	assert.Equal(t, gerr.Rule, "x")
+	assert.Equal(t, gerr.Offset, 10, "Offset should count the whitespace")
+	assert.Equal(t, gerr.Expected, "end of rule")
+}
+
+func TestCompile_UndefinedReference(t *testing.T) {
+	_, err := Grammar{"x": "'a' & y"}.Compile()
+
+	var gerr *GrammarError
+	assert.ErrorAs(t, err, &gerr)
+	assert.Equal(t, gerr.Rule, "x")
+	assert.Equal(t, gerr.Offset, 6)
+}
+
+func TestParse_Error(t *testing.T) {
+	g := Compile(t, Grammar{"ab": "'a' & 'b'"})
+
+	_, err := g.Parse("ab", "abc")
+
+	var perr *ParseError
+	assert.ErrorAs(t, err, &perr)
+	assert.Equal(t, perr.Offset, 2)
+	assert.Equal(t, perr.Found, "'c'")
+}
+
+func TestParse_ErrorExpected(t *testing.T) {
+	g := Compile(t, Grammar{
+		"pair":  "'(' & digit & { ',' | ';' } & digit & ')'",
+		"digit": "<0-9>",
+	})
+
+	_, err := g.Parse("pair", "(1,2(")
+
+	var perr *ParseError
+	assert.ErrorAs(t, err, &perr)
+	assert.Equal(t, perr.Offset, 4, "Error should be at the furthest failure")
+	assert.Equal(t, perr.Expected, []string{"')'"})
+	assert.Equal(t, perr.Found, "'('")
+
+	_, err = g.Parse("pair", "(1.")
+	assert.ErrorAs(t, err, &perr)
+	assert.Equal(t, perr.Expected, []string{"','", "';'"})
+}
+
+func TestParse_ErrorExpectedRule(t *testing.T) {
+	g := Compile(t, Grammar{
+		"pair":  "'(' & digit & ')'",
+		"digit": "<0-9>",
+	})
+
+	_, err := g.Parse("pair", "(x)")
+
+	assert.Error(t, err)
+	assert.Equal(t, err.Error(), `parsing "pair": line 1 col 2: expected digit, found 'x'`)
+}
+
+func TestParse_ErrorExpectedLiteral(t *testing.T) {
+	g := Compile(t, Grammar{"x": "'(' & { 'true' | 'false' }"})
+
+	_, err := g.Parse("x", "(trap")
+
+	var perr *ParseError
+	assert.ErrorAs(t, err, &perr)
+	assert.Equal(t, perr.Offset, 1, "Literals should fail as a whole")
+	assert.Equal(t, perr.Expected, []string{"'true'", "'false'"})
+}
+
+func TestParse_ErrorPredicate(t *testing.T) {
+	_, err := StringParser(And(Not(Is("a")), Wildcard("")))("a")
+
+	var perr *ParseError
+	assert.ErrorAs(t, err, &perr)
+	assert.Equal(t, perr.Offset, 0)
+	assert.Empty(t, perr.Expected, "Predicates should not be expected")
+}
+
+func TestCompile_UnclosedBracket(t *testing.T) {
+	_, err := Grammar{"x": "'a' & ['b'"}.Compile()
+
+	var gerr *GrammarError
+	assert.ErrorAs(t, err, &gerr)
+	assert.Equal(t, gerr.Offset, 10)
+	assert.Equal(t, gerr.Found, "end of rule")
+}
+
+func TestDiagnose_ParseError(t *testing.T) {
+	g := Compile(t, Grammar{"pair": "'(' & <0-9> & ',' & [' '|'\\n'] & <0-9> & ')'"})
+	input := "(1,\n 2 x"
+
+	_, err := g.Parse("pair", input)
+
+	assert.Equal(t, Diagnose(err, input, 1), `parsing "pair": line 2 col 3: expected ')', found ' '
+ 1 | (1,
+ 2 |  2 x
+   |   ^`)
+}
+
+func TestDiagnose_Context(t *testing.T) {
+	input := "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11"
+	err := &ParseError{Position: Position{Offset: 10, Line: 6, Column: 1}, Found: "'6'"}
+
+	assert.Equal(t, Diagnose(err, input, 0), `line 6 col 1: unexpected '6'
+ 6 | 6
+   | ^`)
+	assert.Equal(t, Diagnose(err, input, 4), `line 6 col 1: unexpected '6'
+  2 | 2
+  3 | 3
+  4 | 4
+  5 | 5
+  6 | 6
+    | ^
+  7 | 7
+  8 | 8
+  9 | 9
+ 10 | 10`)
+}
+
+func TestDiagnose_GrammarError(t *testing.T) {
+	g := Grammar{"x": "'a' &\n\t'b' & ]"}
+
+	_, err := g.Compile()
+
+	assert.Equal(t, g.Diagnose(err, 1), `rule "x": offset 13: expected '!', '&', '\'', <a-zA-Z_>, '[', '(', '*', '<', '$' or '{', found ']'
+ 1 | 'a' &
+ 2 | 	'b' & ]
+   | 	      ^`, "Caret should line up under tabs")
+}
+
+func TestDiagnose_OtherError(t *testing.T) {
+	err := errors.New("oops")
+
+	assert.Equal(t, Diagnose(err, "input", 2), "oops")
+	assert.Equal(t, Grammar{}.Diagnose(err, 2), "oops")
+}
+
+/*
+	Source positions
+*/
+
+func TestSpan_Lines(t *testing.T) {
+	p := And(Is("a\n"), Many(Wildcard("")))
+
+	matches, tree, _ := SetUp(p, "a\nbé\nc")
+
+	assert.True(t, matches)
+	assert.Equal(t, tree.Span(), Span{Position{0, 1, 1}, Position{7, 3, 2}})
+
+	many := tree.nthChild(1)
+	assert.Equal(t, many.Span().Start, Position{2, 2, 1})
+	assert.Equal(t, many.nthChild(2).Span().Start, Position{5, 2, 3},
+		"Columns should count runes")
+}
+
+func TestSpan_Empty(t *testing.T) {
+	matches, tree, _ := SetUp(And(Is("a"), Optional(Is("b"))), "ac")
+
+	assert.True(t, matches)
+	assert.Equal(t, tree.nthChild(1).Span(), Span{Position{1, 1, 2}, Position{1, 1, 2}})
+}
+
+func TestSpan_Rule(t *testing.T) {
+	g := Compile(t, Grammar{"ab": "'a' & b", "b": "'b'"})
+
+	tree, err := g.Parse("ab", "ab")
+
+	assert.NoError(t, err)
+	assert.Equal(t, tree.nthChild(1).typ, "b")
+	assert.Equal(t, tree.nthChild(1).Span().Start.Column, 2)
+}
+
+func TestParse_ErrorPosition(t *testing.T) {
+	_, err := StringParser(Is("a\nb"))("a\nb\nc")
+
+	var perr *ParseError
+	assert.ErrorAs(t, err, &perr)
+	assert.Equal(t, perr.Position, Position{3, 2, 2})
+	assert.Equal(t, err.Error(), "line 2 col 2: expected end of input, found '\\n'")
+}
+
+/*
+	Reading trees
+*/
+
+func TestCst_Accessors(t *testing.T) {
+	tree := NewCst("pair", []*Cst{
+		NewLeaf("key", "a"),
+		NewLeaf("sep", ":"),
+		NewCst("value", []*Cst{NewLeaf("digit", "1"), NewLeaf("digit", "2")}),
+	})
+
+	assert.Equal(t, tree.Type(), "pair")
+	assert.Equal(t, tree.Value(), "")
+	assert.Len(t, tree.Children(), 3)
+	assert.Equal(t, tree.Child(1).Value(), ":")
+	assert.Nil(t, tree.Child(3))
+	assert.Nil(t, tree.Child(-1))
+	assert.Equal(t, tree.ChildByType("value").Text(), "12")
+	assert.Nil(t, tree.ChildByType("missing"))
+	assert.Equal(t, tree.Text(), "a:12")
+}
+
+func TestCst_TextOfParse(t *testing.T) {
+	g := Compile(t, Grammar{"digits": "digit & [digit]", "digit": "'1'|'2'|'3'"})
+
+	tree, err := g.Parse("digits", "321")
+
+	assert.NoError(t, err)
+	assert.Equal(t, tree.Text(), "321")
+	assert.Equal(t, tree.Child(0).Type(), "digit")
+}
+
+/*
+	Left recursion
+*/
+
+func TestLeftRecursion_Rejected(t *testing.T) {
+	g := Grammar{
+		"list": "{ more & ',' & 'x' } | 'x'",
+		"more": "list",
+	}
+
+	_, err := g.Compile()
+
+	var gerr *GrammarError
+	assert.ErrorAs(t, err, &gerr)
+	assert.True(t, errors.Is(err, ErrLeftRecursion))
+	assert.Equal(t, err.Error(), `rule "list": offset 0: left recursive: list -> more -> list`)
+
+	_, err = g.GetParser("more")
+	assert.Equal(t, err.Error(), `rule "more": offset 0: left recursive: more -> list -> more`)
+}
+
+func TestLeftRecursion_Direct(t *testing.T) {
+	g := CompileLeftRecursive(t, Grammar{
+		"expr": "{ expr & '-' & num } | num",
+		"num":  "'1' | '2' | '3'",
+	})
+
+	tree, err := g.Parse("expr", "3-2-1")
+
+	assert.NoError(t, err)
+	assert.Equal(t, tree.Text(), "3-2-1")
+
+	// (3-2)-1, the left operand is the nested expression
+	sub := tree.Child(0)
+	assert.Equal(t, sub.Child(0).Type(), "expr")
+	assert.Equal(t, sub.Child(0).Text(), "3-2")
+	assert.Equal(t, sub.Child(2).Text(), "1")
+}
+
+func TestLeftRecursion_Indirect(t *testing.T) {
+	g := CompileLeftRecursive(t, Grammar{
+		"list": "{ more & ',' & 'x' } | 'x'",
+		"more": "list",
+	})
+
+	tree, err := g.Parse("list", "x,x,x")
+
+	assert.NoError(t, err)
+	assert.Equal(t, tree.Text(), "x,x,x")
+}
+
+func TestLeftRecursion_Packrat(t *testing.T) {
+	g := CompileLeftRecursive(t, Grammar{
+		"expr": "{ expr & '+' & term } | term",
+		"term": "{ term & '*' & num } | num",
+		"num":  "'1' | '2' | '3'",
+	})
+	p := GetParser(t, g, "expr")
+	input := "1+2*3*1+2"
+
+	_, tree, _ := SetUp(p, input)
+
+	l := NewLexer(input)
+	l.EnablePackrat()
+	matches, memoTree := p(l)
+
+	assert.True(t, matches)
+	assert.True(t, l.Done())
+	assert.Equal(t, memoTree.String(), tree.String())
+}
+
+func TestLeftRecursion_NoBase(t *testing.T) {
+	g := CompileLeftRecursive(t, Grammar{"loop": "loop & 'a'"})
+
+	matches, _, l := SetUp(GetParser(t, g, "loop"), "aaa")
+
+	assert.False(t, matches, "Rule without a base case can't match")
+	assert.Equal(t, l.pos(), 0)
+}
+
+/*
+	Character classes
+*/
+
+func TestClass_Range(t *testing.T) {
+	p := Class(false, RuneRange{'a', 'z'}, RuneRange{'_', '_'})
+
+	matches, tree, l := SetUp(p, "q1")
+	assert.True(t, matches)
+	assert.Equal(t, tree.Value(), "q")
+	assert.Equal(t, l.pos(), 1)
+
+	matches, _, l = SetUp(p, "_")
+	assert.True(t, matches)
+
+	matches, _, l = SetUp(p, "Q")
+	assert.False(t, matches, "Rune outside of the ranges shouldn't match")
+	assert.Equal(t, l.pos(), 0)
+}
+
+func TestClass_Negated(t *testing.T) {
+	p := Class(true, RuneRange{'0', '9'})
+
+	matches, tree, l := SetUp(p, "é")
+	assert.True(t, matches)
+	assert.Equal(t, tree.Value(), "é")
+	assert.Equal(t, l.pos(), 2)
+
+	matches, _, _ = SetUp(p, "5")
+	assert.False(t, matches)
+
+	matches, _, _ = SetUp(p, "")
+	assert.False(t, matches, "Negated class doesn't match empty string")
+}
+
+func TestClass_Shorthand(t *testing.T) {
+	g := Compile(t, Grammar{
+		"ident": "<a-zA-Z_> & [<a-zA-Z0-9_>]",
+		"other": `<^\>\-a>`,
+	})
+
+	tree, err := g.Parse("ident", "snake_Case9")
+	assert.NoError(t, err)
+	assert.Equal(t, tree.Text(), "snake_Case9")
+
+	_, err = g.Parse("ident", "9lives")
+	assert.Error(t, err)
+
+	_, err = g.Parse("other", "b")
+	assert.NoError(t, err)
+	for _, input := range []string{">", "-", "a"} {
+		_, err = g.Parse("other", input)
+		assert.Error(t, err, "Escaped characters should be excluded")
+	}
+}
+
+func TestClass_Descending(t *testing.T) {
+	_, err := Grammar{"x": "'a' & <z-a>"}.Compile()
+
+	var gerr *GrammarError
+	assert.ErrorAs(t, err, &gerr)
+	assert.Equal(t, gerr.Offset, 7)
+}
+
+func TestReference_Identifiers(t *testing.T) {
+	g := Compile(t, Grammar{
+		"GlossEntry": "json_value & int2",
+		"json_value": "'v'",
+		"int2":       "'2'",
+		"_":          "GlossEntry",
+	})
+
+	tree, err := g.Parse("_", "v2")
+
+	assert.NoError(t, err)
+	assert.Equal(t, tree.Child(0).Type(), "json_value")
+	assert.Equal(t, tree.Child(1).Type(), "int2")
+}
+
+func TestReference_LeadingDigit(t *testing.T) {
+	_, err := Grammar{"x": "2x"}.Compile()
+
+	var gerr *GrammarError
+	assert.ErrorAs(t, err, &gerr)
+}
+
+/*
+	Whitespace in rules
+*/
+
+func TestLiteral_KeepsWhitespace(t *testing.T) {
+	g := Compile(t, Grammar{
+		"keyword": " 'else if' ",
+		"spaces":  " [ ' ' | <\t> ] ",
+	})
+
+	_, err := g.Parse("keyword", "else if")
+	assert.NoError(t, err)
+
+	_, err = g.Parse("keyword", "elseif")
+	assert.Error(t, err, "The space is part of the literal")
+
+	_, err = g.Parse("spaces", " \t ")
+	assert.NoError(t, err)
+}
+
+func TestRule_Stripped(t *testing.T) {
+	g := Grammar{"x": " 'a b' &\n\t< \\>> | *' ' "}
+
+	assert.Equal(t, g.Rule("x"), `'a b'&< \>>|*' '`)
+}
+
+func TestRule_Comments(t *testing.T) {
+	g := Grammar{"x": `
+		'#' | '//'  # a hash, // or slash
+		| <#/>      // in a class
+		| /* in a wildcard */ *'/*'
+	`}
+
+	assert.Equal(t, g.Rule("x"), `'#'|'//'|<#/>|*'/*'`)
+
+	compiled := Compile(t, g)
+	_, err := compiled.Parse("x", "#")
+	assert.NoError(t, err)
+}
+
+func TestRule_UnclosedComment(t *testing.T) {
+	_, err := Grammar{"x": "'a' /* b"}.Compile()
+
+	var gerr *GrammarError
+	assert.ErrorAs(t, err, &gerr)
+	assert.Equal(t, gerr.Offset, 4)
+}
+
+/*
+	Escapes in literals
+*/
+
+func TestLiteral_Escapes(t *testing.T) {
+	g := Compile(t, Grammar{
+		"quote":     `'\''`,
+		"backslash": `'\\'`,
+		"controls":  `'\n\t'`,
+		"unicode":   `'\u00e9\x41\101'`,
+		"dquote":    `'\"'`,
+		"notQuote":  `*'\''`,
+	})
+
+	inputs := map[string]string{
+		"quote":     "'",
+		"backslash": `\`,
+		"controls":  "\n\t",
+		"unicode":   "éAA",
+		"dquote":    `"`,
+		"notQuote":  "a",
+	}
+	for rule, input := range inputs {
+		_, err := g.Parse(rule, input)
+		assert.NoError(t, err, rule)
+	}
+
+	_, err := g.Parse("notQuote", "'")
+	assert.Error(t, err)
+}
+
+func TestLiteral_InvalidEscape(t *testing.T) {
+	_, err := Grammar{"x": `'ab\qc'`}.Compile()
+
+	var gerr *GrammarError
+	assert.ErrorAs(t, err, &gerr)
+	assert.Equal(t, gerr.Offset, 3)
+	assert.Equal(t, gerr.Expected, "a valid escape sequence")
+}
+
+func TestClass_Escapes(t *testing.T) {
+	g := Compile(t, Grammar{"x": `<à-ÿ\x41>`})
+
+	for _, input := range []string{"é", "A"} {
+		_, err := g.Parse("x", input)
+		assert.NoError(t, err, input)
+	}
+}
+
+func TestClass_ByteEscape(t *testing.T) {
+	// as in a Go rune literal, \xe9 is the code point rather than a byte
+	g := Compile(t, Grammar{"x": `<\xe9>`, "range": `<\xe0-\xff>`})
+
+	_, err := g.Parse("x", "é")
+	assert.NoError(t, err)
+
+	_, err = g.Parse("range", "ÿ")
+	assert.NoError(t, err)
+
+	_, err = g.Parse("x", "\xe9")
+	assert.Error(t, err, "A lone byte isn't the code point")
+}
+
+/*
+	Precedence of & and |
+*/
+
+func TestExpression_Precedence(t *testing.T) {
+	g := Compile(t, Grammar{
+		"andFirst": "'a' & 'b' | 'c'",
+		"orFirst":  "'a' | 'b' & 'c'",
+		"grouped":  "{ 'a' | 'b' } & 'c'",
+	})
+
+	cases := []struct {
+		rule, input string
+		valid       bool
+	}{
+		{"andFirst", "ab", true},
+		{"andFirst", "c", true},
+		{"andFirst", "ac", false},
+		{"orFirst", "a", true},
+		{"orFirst", "bc", true},
+		{"orFirst", "b", false},
+		{"grouped", "ac", true},
+		{"grouped", "bc", true},
+		{"grouped", "a", false},
+	}
+	for _, tc := range cases {
+		_, err := g.Parse(tc.rule, tc.input)
+		assert.Equal(t, err == nil, tc.valid, tc.rule+" "+tc.input)
+	}
+}
+
+func TestExpression_Shape(t *testing.T) {
+	g := Compile(t, Grammar{"x": "'a' & 'b' | 'c' | 'd'"})
+
+	tree, err := g.Parse("x", "ab")
+
+	assert.NoError(t, err)
+	assert.Equal(t, tree.String(), "x(And(And(Is<a>), And(Is<b>)))")
+}
+
+/*
+	Repetition
+*/
+
+func TestOneOrMore_Flat(t *testing.T) {
+	matches, tree, l := SetUp(OneOrMore(Is("a")), "aaab")
+
+	assert.True(t, matches)
+	assert.Equal(t, l.pos(), 3)
+	assert.Equal(t, tree.String(), "OneOrMore(Is<a>, Is<a>, Is<a>)")
+}
+
+func TestOneOrMore_None(t *testing.T) {
+	matches, _, l := SetUp(OneOrMore(Is("a")), "b")
+
+	assert.False(t, matches, "OneOrMore needs at least one match")
+	assert.Equal(t, l.pos(), 0)
+}
+
+func TestRepeat_Bounds(t *testing.T) {
+	p := Repeat(Is("a"), 2, 3)
+
+	matches, _, l := SetUp(p, "a")
+	assert.False(t, matches, "Too few matches")
+	assert.Equal(t, l.pos(), 0)
+
+	matches, _, l = SetUp(p, "aa")
+	assert.True(t, matches)
+	assert.Equal(t, l.pos(), 2)
+
+	matches, _, l = SetUp(p, "aaaa")
+	assert.True(t, matches, "Should stop at max")
+	assert.Equal(t, l.pos(), 3)
+}
+
+func TestRepeat_Empty(t *testing.T) {
+	matches, tree, l := SetUp(Repeat(Optional(Is("a")), 2, -1), "b")
+
+	assert.True(t, matches, "Empty matches shouldn't loop forever")
+	assert.Len(t, tree.Children(), 2)
+	assert.Equal(t, l.pos(), 0)
+}
+
+func TestQuantifiers_Shorthand(t *testing.T) {
+	g := Compile(t, Grammar{
+		"optional": "'a' & 'b'?",
+		"many":     "'a'*",
+		"some":     "<0-9>+",
+		"exactly":  "'a'{2}",
+		"atLeast":  "'a'{2,}",
+		"atMost":   "'a'{,2}",
+		"between":  "{ 'a' | 'b' }{1,2} & 'c'",
+	})
+
+	cases := []struct {
+		rule, input string
+		valid       bool
+	}{
+		{"optional", "a", true},
+		{"optional", "ab", true},
+		{"many", "", true},
+		{"many", "aaa", true},
+		{"some", "", false},
+		{"some", "123", true},
+		{"exactly", "a", false},
+		{"exactly", "aa", true},
+		{"exactly", "aaa", false},
+		{"atLeast", "a", false},
+		{"atLeast", "aaaa", true},
+		{"atMost", "", true},
+		{"atMost", "aaa", false},
+		{"between", "abc", true},
+		{"between", "c", false},
+		{"between", "abac", false},
+	}
+	for _, tc := range cases {
+		_, err := g.Parse(tc.rule, tc.input)
+		assert.Equal(t, err == nil, tc.valid, tc.rule+" "+tc.input)
+	}
+}
+
+func TestQuantifiers_InvalidBounds(t *testing.T) {
+	for _, rule := range []string{"'a'{3,2}", "'a'{}", "'a'{,}"} {
+		_, err := Grammar{"x": rule}.Compile()
+
+		var gerr *GrammarError
+		assert.ErrorAs(t, err, &gerr, rule)
+	}
+}
+
+/*
+	Predicates
+*/
+
+func TestNot_NoAdvance(t *testing.T) {
+	matches, tree, l := SetUp(Not(Is("a")), "b")
+
+	assert.True(t, matches, "Not should match when the parser doesn't")
+	assert.Equal(t, tree.Type(), "Not")
+	assert.Equal(t, l.pos(), 0)
+
+	matches, _, l = SetUp(Not(Is("a")), "a")
+
+	assert.False(t, matches, "Not shouldn't match when the parser does")
+	assert.Equal(t, l.pos(), 0)
+}
+
+func TestLookahead_NoAdvance(t *testing.T) {
+	matches, tree, l := SetUp(Lookahead(Is("a")), "a")
+
+	assert.True(t, matches)
+	assert.Len(t, tree.Children(), 0)
+	assert.Equal(t, l.pos(), 0)
+
+	matches, _, _ = SetUp(Lookahead(Is("a")), "b")
+
+	assert.False(t, matches)
+}
+
+func TestPredicates_Shorthand(t *testing.T) {
+	g := Compile(t, Grammar{
+		"keyword": "'if' & !<a-z>",
+		"comment": "'/*' & [ !'*/' & *'' ] & '*/'",
+		"peek":    "&'ab' & 'a'",
+		"double":  "!!'a' & *''",
+	})
+
+	cases := []struct {
+		rule, input string
+		valid       bool
+	}{
+		{"keyword", "if", true},
+		{"keyword", "iffy", false},
+		{"comment", "/* a * b */", true},
+		{"comment", "/* a */ b */", false},
+		{"peek", "a", false},
+		{"double", "a", true},
+		{"double", "b", false},
+	}
+	for _, tc := range cases {
+		_, err := g.Parse(tc.rule, tc.input)
+		assert.Equal(t, err == nil, tc.valid, tc.rule+" "+tc.input)
+	}
+
+	matches, _, l := SetUp(GetParser(t, g, "peek"), "ab")
+	assert.True(t, matches)
+	assert.Equal(t, l.pos(), 1, "Lookahead shouldn't consume input")
+}
+
+/*
+	End of input
+*/
+
+func TestEOF_Empty(t *testing.T) {
+	matches, tree, l := SetUp(EOF(), "")
+
+	assert.True(t, matches)
+	assert.Equal(t, tree.Type(), "EOF")
+	assert.Equal(t, l.pos(), 0)
+}
+
+func TestEOF_Remainder(t *testing.T) {
+	matches, _, l := SetUp(And(Is("a"), EOF()), "ab")
+
+	assert.False(t, matches, "EOF shouldn't match before the end")
+	assert.Equal(t, l.pos(), 1)
+}
+
+func TestEOF_Shorthand(t *testing.T) {
+	g := Compile(t, Grammar{
+		"statements": "[ statement ] & $",
+		"statement":  "'x' & ';'",
+	})
+
+	matches, _, l := SetUp(GetParser(t, g, "statements"), "x;x;x;")
+	assert.True(t, matches)
+	assert.True(t, l.Done())
+
+	matches, _, _ = SetUp(GetParser(t, g, "statements"), "x;x;y;")
+	assert.False(t, matches, "Many shouldn't stop early unnoticed")
+}
+
+/*
+	Actions
+*/
+
+func TestMap_Result(t *testing.T) {
+	count := func(node *Cst) (interface{}, error) {
+		return len(node.Children()), nil
+	}
+
+	matches, tree, l := SetUp(Map(Many(Is("a")), count), "aaa")
+
+	assert.True(t, matches)
+	assert.Equal(t, tree.Type(), "Many", "Map shouldn't change the tree")
+	assert.Equal(t, tree.Result(), 3)
+	assert.Equal(t, l.pos(), 3)
+}
+
+func TestMap_Error(t *testing.T) {
+	failure := errors.New("no b's")
+	refuse := func(node *Cst) (interface{}, error) {
+		return nil, failure
+	}
+
+	matches, _, l := SetUp(And(Is("a"), Map(Is("b"), refuse)), "ab")
+
+	assert.False(t, matches, "Failing action should fail the match")
+	assert.Equal(t, l.pos(), 1)
+}
+
+func TestSetAction_Eval(t *testing.T) {
+	g := CompileLeftRecursive(t, Grammar{
+		"sum":   "{ sum & '+' & digit } | digit",
+		"digit": "<0-9>",
+	})
+	assert.NoError(t, g.SetAction("digit", func(node *Cst) (interface{}, error) {
+		return strconv.Atoi(node.Text())
+	}))
+	assert.NoError(t, g.SetAction("sum", func(node *Cst) (interface{}, error) {
+		child := node.Child(0)
+		if child.Type() == "digit" {
+			return child.Result(), nil
+		}
+		return child.Child(0).Result().(int) + child.Child(2).Result().(int), nil
+	}))
+
+	value, err := g.Eval("sum", "1+2+3+4")
+
+	assert.NoError(t, err)
+	assert.Equal(t, value, 10)
+
+	var gerr *GrammarError
+	assert.ErrorAs(t, g.SetAction("missing", nil), &gerr)
+}
+
+func TestSetAction_Error(t *testing.T) {
+	g := Compile(t, Grammar{
+		"pair":  "digit & ',' & digit",
+		"digit": "<0-9>",
+	})
+	failure := errors.New("zero")
+	assert.NoError(t, g.SetAction("digit", func(node *Cst) (interface{}, error) {
+		if node.Text() == "0" {
+			return nil, failure
+		}
+		return node.Text(), nil
+	}))
+
+	_, err := g.Eval("pair", "1,0")
+
+	var perr *ParseError
+	assert.ErrorAs(t, err, &perr)
+	assert.Equal(t, perr.Column, 3)
+	assert.True(t, errors.Is(err, failure), "Action error should be wrapped")
+}
+
+func TestSetAction_ErrorWholeInput(t *testing.T) {
+	g := Compile(t, Grammar{"digits": "[<0-9>]"})
+	failure := errors.New("too long")
+	assert.NoError(t, g.SetAction("digits", func(node *Cst) (interface{}, error) {
+		return nil, failure
+	}))
+
+	_, err := g.Eval("digits", "123")
+
+	var perr *ParseError
+	assert.ErrorAs(t, err, &perr)
+	assert.Equal(t, perr.Column, 1)
+	assert.True(t, errors.Is(err, failure), "Action error should outrank failures within its match")
+}
+
+/*
+	Recovery
+*/
+
+func TestRecover_Skip(t *testing.T) {
+	statement := And(Is("x"), Is(";"))
+
+	matches, tree, l := SetUp(Many(Recover(statement, Is(";"))), "x;?;x;")
+
+	assert.True(t, matches)
+	assert.True(t, l.Done())
+	assert.Len(t, tree.Children(), 3)
+
+	bad := tree.Child(1)
+	assert.Equal(t, bad.Type(), "Error")
+	assert.Equal(t, bad.Value(), "?;", "Error should span the skipped input")
+	assert.Equal(t, bad.Err().Offset, 2)
+	assert.Equal(t, bad.Err().Expected, []string{"'x'"})
+	assert.Nil(t, tree.Child(0).Err())
+}
+
+func TestRecover_Backtrack(t *testing.T) {
+	p := Or(And(Recover(Is("a"), Is(";")), Is("!")), Wildcard(""))
+
+	matches, tree, _ := SetUp(p, "b;")
+
+	assert.True(t, matches)
+	assert.Empty(t, tree.Errors(), "Errors of discarded alternatives shouldn't count")
+}
+
+func TestRecover_Shorthand(t *testing.T) {
+	g := Compile(t, Grammar{
+		"block":     "'{' & [ statement ~ { ';' | &'}' } ] & '}'",
+		"statement": "<a-z> & '=' & <0-9> & ';'",
+	})
+	input := "{a=1;b=?;c=2;d}"
+
+	tree, err := g.Parse("block", input)
+
+	assert.NotNil(t, tree, "Parse should return the partial tree")
+	assert.Equal(t, tree.Text(), input)
+
+	var errs ParseErrors
+	assert.ErrorAs(t, err, &errs)
+	assert.Len(t, errs, 2)
+	assert.Equal(t, errs[0].Error(), `parsing "block": line 1 col 8: expected <0-9>, found '?'`)
+	assert.Equal(t, errs[1].Offset, 14)
+
+	var perr *ParseError
+	assert.ErrorAs(t, err, &perr)
+	assert.Equal(t, Diagnose(err, input, 0), `parsing "block": line 1 col 8: expected <0-9>, found '?'
+ 1 | {a=1;b=?;c=2;d}
+   |        ^
+parsing "block": line 1 col 15: expected '=', found '}'
+ 1 | {a=1;b=?;c=2;d}
+   |               ^`)
+
+	_, err = g.Parse("block", "{a=1;b=2;}")
+	assert.NoError(t, err)
+}
+
+/*
+	Grammar files
+*/
+
+func TestParseGrammarFile_Order(t *testing.T) {
+	f, err := ParseGrammarFile(strings.NewReader(`
+		// a comma separated list
+		list = item & [',' & item] ;  # of one or more items
+		item = <a-z>+ /* ; is fine in a comment */ | ';' ;
+	`))
+
+	assert.NoError(t, err)
+	assert.Equal(t, f.Order, []string{"list", "item"})
+	assert.Equal(t, f.Start(), "list")
+	assert.Equal(t, f.Rule("item"), "<a-z>+|';'")
+
+	g := Compile(t, f.Grammar)
+	_, err = g.Parse(f.Start(), "ab,;,c")
+	assert.NoError(t, err)
+}
+
+func TestParseGrammarFile_Errors(t *testing.T) {
+	var perr *ParseError
+
+	_, err := ParseGrammarFile(strings.NewReader("a = 'a' ;\nb 'b' ;"))
+	assert.ErrorAs(t, err, &perr)
+	assert.Equal(t, perr.Line, 2)
+	assert.Equal(t, perr.Column, 3)
+
+	_, err = ParseGrammarFile(strings.NewReader("a = 'a' ;\na = 'b' ;"))
+	assert.ErrorAs(t, err, &perr)
+	assert.Equal(t, err.Error(), `line 2 col 1: rule "a" is declared twice`)
+
+	_, err = ParseGrammarFile(strings.NewReader("a = 'a' & ;"))
+	assert.NoError(t, err, "Rules are checked when compiled")
+}
+
+/*
+	Validation
+*/
+
+func TestValidate_Sound(t *testing.T) {
+	g := Grammar{
+		"expr": "term & [ '+' & term ]",
+		"term": "<0-9>",
+	}
+
+	assert.NoError(t, g.Validate("expr"))
+}
+
+func TestValidate_Everything(t *testing.T) {
+	g := Grammar{
+		"start":  "a & missing & b",
+		"a":      "'a' & ]",
+		"b":      `'\q' | gone`,
+		"orphan": "helper & orphan",
+		"helper": "'h'",
+		"self":   "self & 'x'",
+	}
+
+	err := g.Validate("start")
+
+	var errs GrammarErrors
+	assert.ErrorAs(t, err, &errs)
+	assert.Equal(t, err.Error(), `rule "a": offset 6: expected '!', '&', '\'', <a-zA-Z_>, '[', '(', '*', '<', '$' or '{', found ']'
+rule "b": offset 7: expected a defined rule, found reference to "gone"
+rule "helper": offset 0: unreachable from "start"
+rule "orphan": offset 0: unused
+rule "self": offset 0: left recursive: self -> self
+rule "self": offset 0: unused
+rule "start": offset 4: expected a defined rule, found reference to "missing"`)
+
+	assert.True(t, errors.Is(err, ErrUnusedRule))
+	assert.True(t, errors.Is(err, ErrUnreachableRule))
+	assert.True(t, errors.Is(err, ErrLeftRecursion))
+}
+
+func TestValidate_CompileError(t *testing.T) {
+	g := Grammar{"start": "x", "x": `'\q'`}
+
+	err := g.Validate("start")
+
+	var errs GrammarErrors
+	assert.ErrorAs(t, err, &errs)
+	assert.Len(t, errs, 1, "Errors should be reported once, for their own rule")
+	assert.Equal(t, errs[0].Rule, "x")
+}
+
+func TestValidate_CompileErrors(t *testing.T) {
+	// neither error is found until the rule is compiled, and compiling
+	// a would compile b first
+	g := Grammar{"start": "a", "a": "b & [('x')]", "b": "[('y')]"}
+
+	err := g.Validate("start")
+
+	assert.Equal(t, err.Error(), `rule "a": offset 4: repeats an expression which may match nothing: ('x')
+rule "b": offset 0: repeats an expression which may match nothing: ('y')`)
+}
+
+func TestValidate_MissingStart(t *testing.T) {
+	err := Grammar{"a": "'a'"}.Validate("b")
+
+	assert.Equal(t, err.Error(), `rule "a": offset 0: unused
+rule "b": offset 0: expected a rule definition`)
+}
+
+/*
+	Analysis
+*/
+
+func TestAnalyze_NullableFirst(t *testing.T) {
+	a := Grammar{
+		"list":  "item & [',' & item]",
+		"item":  "(sign) & <0-9> | ''",
+		"sign":  "'+' | '-'",
+		"quote": `*'"' | $`,
+	}.Analyze()
+
+	assert.True(t, a.Nullable("item"))
+	assert.True(t, a.Nullable("list"), "A sequence of nullable terms is nullable")
+	assert.False(t, a.Nullable("sign"))
+	assert.True(t, a.Nullable("quote"))
+
+	assert.Equal(t, a.First("list"), []string{"'+'", "','", "'-'", "<0-9>"})
+	assert.Equal(t, a.First("quote"), []string{`any character but '"'`})
+}
+
+func TestAnalyze_JSON(t *testing.T) {
+	a := readJSON(t).Analyze()
+
+	assert.True(t, a.Nullable("ws"))
+	assert.False(t, a.Nullable("value"))
+	assert.Equal(t, a.First("number"), []string{"'-'", "<0-9>", "<1-9>"})
+	assert.NoError(t, a.LeftRecursion())
+}
+
+func TestAnalyze_LeftRecursion(t *testing.T) {
+	a := Grammar{
+		"expr":   "{ expr & '+' & term } | term",
+		"term":   "(sign) & factor",
+		"sign":   "'-'",
+		"factor": "<0-9> | '(' & expr & ')' | &term & 'x'",
+	}.Analyze()
+
+	err := a.LeftRecursion()
+
+	assert.True(t, errors.Is(err, ErrLeftRecursion))
+	assert.Equal(t, err.Error(), `rule "expr": offset 0: left recursive: expr -> expr
+rule "factor": offset 0: left recursive: factor -> term -> factor`)
+}
+
+func TestCompile_NullableRepetition(t *testing.T) {
+	for rule, offset := range map[string]int{
+		"[('x')]":          0,
+		"'a' & ''*":        8,
+		"('x')+":           5,
+		"{ 'a'? }{2,}":     8,
+		"'a'?{2} & 'b'? *": 15,
+		"[ empty ]":        0,
+	} {
+		_, err := Grammar{"x": rule, "empty": "('e')"}.Compile()
+
+		var gerr *GrammarError
+		assert.ErrorAs(t, err, &gerr, rule)
+		assert.True(t, errors.Is(err, ErrNullableRepetition), rule)
+		assert.Equal(t, gerr.Offset, offset, rule)
+	}
+
+	_, err := Grammar{"x": "'a'?{3} & [ 'b' ~ ';' ]"}.Compile()
+	assert.NoError(t, err, "Bounded repetitions and recovery points are fine")
+}
+
+func TestAnalyze_ShadowedAlternatives(t *testing.T) {
+	a := Grammar{
+		"e":      "'e' | 'e+' | 'E' | 'E-'",
+		"number": "digits | { digits & 'e' & digits }",
+		"digits": "<0-9>+",
+		"opt":    "'x' | ('y') | 'z'",
+		"group":  "{ 'a' | 'ab' } & { 'c' & 'd' | 'cd' }",
+		"fine":   "'e+' | 'e' | &'x' & 'xy' | 'x'",
+	}.Analyze()
+
+	err := a.ShadowedAlternatives()
+
+	assert.True(t, errors.Is(err, ErrShadowedAlternative))
+	assert.Equal(t, err.Error(), `rule "e": offset 6: unreachable alternative: 'e+', as 'e' matches first
+rule "e": offset 19: unreachable alternative: 'E-', as 'E' matches first
+rule "group": offset 8: unreachable alternative: 'ab', as 'a' matches first
+rule "group": offset 31: unreachable alternative: 'cd', as 'c'&'d' matches first
+rule "number": offset 9: unreachable alternative: {digits&'e'&digits}, as digits matches first
+rule "opt": offset 14: unreachable alternative: 'z', as ('y') matches first`)
+
+	assert.NoError(t, readJSON(t).Analyze().ShadowedAlternatives())
+
+	err = Grammar{"e": "'e' | 'e+'"}.Validate("e")
+	assert.True(t, errors.Is(err, ErrShadowedAlternative), "Validate should report shadowing")
+}
+
+func TestAnalyze_RecoveryThenFailure(t *testing.T) {
+	// the recovery point always matches, but what follows it may not
+	g := Grammar{"s": "{ x ~ ';' & 'y' } | 'z'", "x": "'x'"}
+
+	assert.NoError(t, g.Analyze().ShadowedAlternatives())
+	assert.NoError(t, g.Validate("s"))
+
+	compiled, err := g.Compile()
+	assert.NoError(t, err)
+	tree, err := compiled.Parse("s", "z")
+	assert.NoError(t, err)
+	assert.Equal(t, tree.Text(), "z")
+}
+
+/*
+	Code generation
+*/
+
+// parses each input with the named rule of a parser generated from the
+// grammar, and with the compiled grammar, returning the results of
+// each in the same format
+func generatedResults(t *testing.T, g Grammar, rule string, inputs []string) ([]string, []string) {
+	goTool, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("go tool not found")
+	}
+
+	dir := t.TempDir()
+	var src bytes.Buffer
+	assert.NoError(t, g.Generate(&src, "main", rule))
+
+	harness := `package main
+
+import (
+	"fmt"
+	"os"
+)
+
+func main() {
+	for _, input := range os.Args[2:] {
+		tree, err := ParseRule(os.Args[1], input)
+		result := ""
+		if tree != nil {
+			result = fmt.Sprintf("%v %v ", tree, tree.Span())
+		}
+		fmt.Printf("%q\n", result+fmt.Sprintf("%q", err))
+	}
+}
+`
+	files := map[string]string{
+		"go.mod":    "module generated\n\ngo 1.20\n",
+		"parser.go": src.String(),
+		"main.go":   harness,
+	}
+	for name, text := range files {
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(text), 0644))
+	}
+
+	cmd := exec.Command(goTool, append([]string{"run", ".", rule}, inputs...)...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GOFLAGS=-mod=mod", "GOPROXY=off")
+	out, err := cmd.CombinedOutput()
+	if !assert.NoError(t, err, string(out)) {
+		t.FailNow()
+	}
+
+	c, err := g.Compile()
+	assert.NoError(t, err)
+	p, _ := c.GetParser(rule)
+
+	expected := []string{}
+	for _, input := range inputs {
+		l := NewLexer(input)
+		l.EnablePackrat()
+		matches, tree := p(l)
+		tree, err := finish(l, matches, tree, rule)
+
+		result := ""
+		if tree != nil {
+			result = fmt.Sprintf("%v %v ", tree, tree.Span())
+		}
+		expected = append(expected, result+fmt.Sprintf("%q", err))
+	}
+
+	actual := []string{}
+	for _, line := range strings.Split(strings.TrimSuffix(string(out), "\n"), "\n") {
+		result, err := strconv.Unquote(line)
+		assert.NoError(t, err, line)
+		actual = append(actual, result)
+	}
+	return actual, expected
+}
+
+func TestGenerate_SameResults(t *testing.T) {
+	g := Grammar{
+		"block":     "'{' & [ statement ~ { ';' | &'}' } ] & '}' & $",
+		"statement": "name & '=' & value & ';' | 'skip' & (';')",
+		"name":      "!keyword & <a-zA-Z_> & <a-zA-Z0-9_>*",
+		"keyword":   "'skip' & !<a-z>",
+		"value":     "number | string | '[' & (value & [',' & value]) & ']'",
+		"number":    "('-') & <0-9>{1,3} & ('.' & <0-9>+)",
+		"string":    `'"' & [ '\\' & *'' | *'"\\' ] & '"'`,
+	}
+	inputs := []string{
+		`{}`,
+		`{a=1;b="x\"y";skip;c=[1,-2.5,"z"];}`,
+		`{a=1;b=?;skip c=2;d}`,
+		`{a=1234;}`,
+		`{skip=1;}`,
+		`{a=[1,];`,
+		`{a=1;}x`,
+		"{\n  a = 1;\n}",
+		``,
+	}
+
+	actual, expected := generatedResults(t, g, "block", inputs)
+
+	assert.Equal(t, actual, expected)
+}
+
+func TestGenerate_SharedRuntime(t *testing.T) {
+	var src strings.Builder
+	assert.NoError(t, Grammar{"a": "'a'"}.Generate(&src, "a", "a"))
+
+	// the trees and errors are copied from runtime.go rather than kept
+	// apart, so that the two can't drift
+	_, shared, err := sharedRuntime()
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(shared, "// A Position is"))
+	assert.Contains(t, src.String(), shared)
+}
+
+func TestGenerate_Errors(t *testing.T) {
+	var src bytes.Buffer
+
+	err := Grammar{"expr": "expr & '+' & 'x' | 'x'"}.Generate(&src, "main", "expr")
+	assert.True(t, errors.Is(err, ErrLeftRecursion))
+
+	err = Grammar{"a": "'a'"}.Generate(&src, "main", "b")
+	assert.Equal(t, err.Error(), `rule "b": offset 0: expected a rule definition`)
+
+	err = Grammar{"a": "b"}.Generate(&src, "main", "a")
+	assert.Equal(t, err.Error(), `rule "a": offset 0: expected a defined rule, found reference to "b"`)
+	assert.Equal(t, src.Len(), 0)
+}
+
+/*
+	Programs
+*/
+
+// describes the result of a parse, including the span of every node
+func describeResult(tree *Cst, err error) string {
+	result := fmt.Sprintf("%q", err)
+	if tree == nil {
+		return result
+	}
+
+	var walk func(*Cst)
+	walk = func(node *Cst) {
+		result += fmt.Sprintf(" %s%v", node.typ, node.Span())
+		for _, child := range node.children {
+			walk(child)
+		}
+	}
+	walk(tree)
+	return tree.String() + " " + result
+}
+
+// parses each input with the compiled grammar and its program, with
+// and without packrat parsing, asserting the results are the same
+func assertSameResults(t *testing.T, g Grammar, rule string, inputs []string) {
+	c, err := g.CompileLeftRecursive()
+	assert.NoError(t, err)
+	p := c.Program()
+
+	closures, _ := c.GetParser(rule)
+	program, _ := p.GetParser(rule)
+
+	for _, input := range inputs {
+		for _, packrat := range []bool{false, true} {
+			results := []string{}
+
+			for _, parser := range []Parser{closures, program} {
+				l := NewLexer(input)
+				if packrat {
+					l.EnablePackrat()
+				}
+				matches, tree := parser(l)
+				results = append(results, describeResult(finish(l, matches, tree, rule)))
+			}
+			assert.Equal(t, results[1], results[0], input)
+		}
+	}
+}
+
+func TestProgram_SameResults(t *testing.T) {
+	g := Grammar{
+		"block":     "'{' & [ statement ~ { ';' | &'}' } ] & '}' & $",
+		"statement": "name & '=' & value & ';' | 'skip' & (';')",
+		"name":      "!keyword & <a-zA-Z_> & <a-zA-Z0-9_>*",
+		"keyword":   "'skip' & !<a-z>",
+		"value":     "number | string | '[' & (value & [',' & value]) & ']'",
+		"number":    "('-') & <0-9>{1,3} & ('.' & <0-9>+)",
+		"string":    `'"' & [ '\\' & *'' | *'"\\' ] & '"'`,
+	}
+	assertSameResults(t, g, "block", []string{
+		`{}`,
+		`{a=1;b="x\"y";skip;c=[1,-2.5,"z"];}`,
+		`{a=1;b=?;skip c=2;d}`,
+		`{a=1234;}`,
+		`{skip=1;}`,
+		`{a=[1,];`,
+		`{a=1;}x`,
+		"{\n  a = 1;\n}",
+		``,
+	})
+}
+
+func TestProgram_Leftovers(t *testing.T) {
+	// rules which fail without expecting anything are reported where
+	// they leave the lexer
+	for rule, input := range map[string]string{
+		"'a' & !'b'":             "ab",
+		"'ab' & &'c' | 'x'":      "abd",
+		"!'a'":                   "a",
+		"'abc'":                  "abd",
+		"{ 'a' & ('x') } & !'b'": "ab",
+		"other":                  "ab",
+		"'a' & 'b'{0} & !'b'":    "ab",
+	} {
+		assertSameResults(t, Grammar{"x": rule, "other": "'a' & !'b'"}, "x", []string{input, "", "a"})
+	}
+}
+
+func TestProgram_Loops(t *testing.T) {
+	// each round of a loop reuses its choice, so none is left behind
+	// for a later failure to return to
+	g := Grammar{
+		"many":   "{ { ['a'] & 'b' } | 'a' } & 'b'",
+		"repeat": "{ { 'a'{1,3} & 'b' } | 'a' } & 'b'",
+	}
+	for rule := range g {
+		assertSameResults(t, g, rule, []string{"ab", "aab", "abb", "aaabb"})
+	}
+}
+
+func TestProgram_LeftRecursion(t *testing.T) {
+	g := Grammar{
+		"expr":   "{ expr & '+' & term } | term",
+		"term":   "{ term & '*' & factor } | factor",
+		"factor": "<0-9> | '(' & expr & ')'",
+	}
+	assertSameResults(t, g, "expr", []string{"1+2*3+4", "(1+2)*3", "1+", "1+(2*"})
+}
+
+func TestProgram_String(t *testing.T) {
+	p, err := Grammar{"list": "'a' | [ <0-9> ]"}.CompileProgram()
+
+	assert.NoError(t, err)
+	assert.Equal(t, p.String(), `list:
+   0  open
+   1  choice 4
+   2  literal 'a' "And"
+   3  commit 9
+   4  open
+   5  choice 8
+   6  class <0-9> "Class"
+   7  many 6
+   8  close "Many"
+   9  close "list"
+  10  return
+`)
+}
+
+func TestProgram_Errors(t *testing.T) {
+	_, err := Grammar{"a": "b"}.CompileProgram()
+	assert.Equal(t, err.Error(), `rule "a": offset 0: expected a defined rule, found reference to "b"`)
+
+	p, _ := Grammar{"a": "'a'"}.CompileProgram()
+	_, err = p.Parse("b", "a")
+	assert.Equal(t, err.Error(), `rule "b": offset 0: expected a rule definition`)
+}
+
+func TestProgram_Binary(t *testing.T) {
+	g := Grammar{
+		"block":     "'{' & [ statement ~ ';' ] & '}'",
+		"statement": "!'é' & <a-zà-ÿ> & '=' & *';'{1,2}",
+	}
+	p, err := g.CompileProgram()
+	assert.NoError(t, err)
+
+	data, err := p.MarshalBinary()
+	assert.NoError(t, err)
+
+	var q Program
+	assert.NoError(t, q.UnmarshalBinary(data))
+	assert.Equal(t, q.String(), p.String())
+
+	for _, input := range []string{"{a=1;à=22;}", "{é=1;a=123;b}"} {
+		expected, expectedErr := p.Parse("block", input)
+		tree, err := q.Parse("block", input)
+		assert.Equal(t, describeResult(tree, err), describeResult(expected, expectedErr))
+	}
+
+	// flip each byte in turn, which the checksum catches
+	for i := range data {
+		corrupt := append([]byte{}, data...)
+		corrupt[i] ^= 0x40
+		assert.True(t, errors.Is(q.UnmarshalBinary(corrupt), ErrInvalidProgram), i)
+	}
+	assert.True(t, errors.Is(q.UnmarshalBinary(data[:10]), ErrInvalidProgram))
+	assert.Equal(t, q.String(), p.String(), "A failed read should leave the program as it was")
+}
+
+// writes out a program of a single rule 'x' with the given code
+func marshalProgram(t *testing.T, code ...instr) []byte {
+	p := &Program{
+		code:     code,
+		rules:    []programRule{{"x", 0, leaveAtStart, false}},
+		index:    map[string]int{"x": 0},
+		names:    []string{"x"},
+		literals: []programLiteral{newProgramLiteral([]string{"a"})},
+	}
+	data, err := p.MarshalBinary()
+	assert.NoError(t, err)
+	return data
+}
+
+func TestProgram_Unbalanced(t *testing.T) {
+	// each would index an empty stack, or loop forever, if it were run
+	for expected, code := range map[string][]instr{
+		"commit without a choice at 0":        {{opCommit, 1, 0, 0}, {opEmpty, 0, 0, 0}, {opReturn, 0, 0, 0}},
+		"unbalanced return at 0":              {{opReturn, 0, 0, 0}},
+		"unbalanced return at 2":              {{opOpen, 0, 0, 0}, {opEmpty, 0, 0, 0}, {opReturn, 0, 0, 0}},
+		"end of code at 1":                    {{opEmpty, 0, 0, 0}},
+		"close without an open at 1":          {{opEmpty, 0, 0, 0}, {opClose, 0, 0, 0}, {opReturn, 0, 0, 0}},
+		"jump backwards at 0":                 {{opJump, 0, 0, 0}},
+		"failtwice without a predicate at 1":  {{opChoice, 2, 0, 0}, {opFailTwice, 0, 0, 0}, {opEmpty, 0, 0, 0}, {opReturn, 0, 0, 0}},
+		"stacks differ at 3":                  {{opChoice, 3, 0, 0}, {opOpen, 0, 0, 0}, {opLiteral, 0, 0, 0}, {opEmpty, 0, 0, 0}, {opReturn, 0, 0, 0}},
+		"skipdone without a skiptry at 0":     {{opSkipDone, 1, 0, 0}, {opEmpty, 0, 0, 0}, {opReturn, 0, 0, 0}},
+		"skipdone without an error node at 1": {{opSkipTry, 2, 0, 0}, {opSkipDone, 2, 0, 0}, {opEmpty, 0, 0, 0}, {opReturn, 0, 0, 0}},
+		"many without a choice at 1":          {{opEmpty, 0, 0, 0}, {opMany, 0, 0, 0}, {opReturn, 0, 0, 0}},
+		"choice backwards at 1":               {{opEmpty, 0, 0, 0}, {opChoice, 0, 0, 0}, {opReturn, 0, 0, 0}},
+		"repeat without an open, or a node to count at 3": {
+			{opOpen, 0, 0, 0}, {opChoice, 4, 0, 0}, {opMark, 0, 0, 0}, {opRepeat, 2, 5, -1},
+			{opRepeatEnd, 5, 0, 0}, {opReturn, 0, 0, 0},
+		},
+	} {
+		var p Program
+		err := p.UnmarshalBinary(marshalProgram(t, code...))
+		assert.True(t, errors.Is(err, ErrInvalidProgram), expected)
+		assert.EqualError(t, err, `invalid program: rule "x": `+expected)
+	}
+
+	// a rule which calls itself before consuming input has its seed
+	// grown, as it would recurse forever otherwise
+	var p Program
+	assert.NoError(t, p.UnmarshalBinary(marshalProgram(t,
+		instr{opOpen, 0, 0, 0}, instr{opChoice, 5, 0, 0}, instr{opCall, 0, 0, 0},
+		instr{opLiteral, 0, 0, 0}, instr{opCommit, 6, 0, 0}, instr{opLiteral, 0, 0, 0},
+		instr{opClose, 0, 0, 0}, instr{opReturn, 0, 0, 0})))
+	assert.True(t, p.leftRecursive("x"))
+
+	tree, err := p.Parse("x", "aaa")
+	assert.NoError(t, err)
+	assert.Equal(t, tree.Text(), "aaa")
+}
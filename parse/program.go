@@ -0,0 +1,1426 @@
+package parse
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"strings"
+)
+
+/////////////////////// Parsing Machine ////////////////////////
+
+/*
+	A CompiledGrammar is a tree of closures, one for every combinator
+	in every rule. A Program is the same grammar compiled to a flat
+	list of instructions, in the style of LPeg, which a small machine
+	runs over a Lexer. e.g. the rule
+
+		list = 'a' | [ <0-9> ]
+
+	compiles to
+
+		list:
+		   0  open
+		   1  choice 4
+		   2  literal 'a' "And"
+		   3  commit 9
+		   4  open
+		   5  choice 8
+		   6  class <0-9> "Class"
+		   7  many 6
+		   8  close "Many"
+		   9  close "list"
+		  10  return
+
+	Choice saves the position, along with the nodes built so far, and
+	names the instruction to carry on from if what follows fails.
+	Commit discards the choice once there is no need to go back, while
+	a failure returns to the most recent choice. Open and close build
+	a node from the nodes matched in between. References to other
+	rules are calls, which go through the memo table of the lexer as
+	those of a CompiledGrammar do, so packrat parsing and left recursion
+	work the same way.
+
+	A Program builds the same trees, and reports the same errors, as
+	the CompiledGrammar it was compiled from, but doesn't support
+	actions. It can be written out with MarshalBinary, and read back
+	with UnmarshalBinary, so that a grammar needn't be compiled every
+	time a program starts.
+*/
+
+var (
+	// data which UnmarshalBinary can't read as a Program
+	ErrInvalidProgram = errors.New("invalid program")
+)
+
+// A Program is a grammar compiled to instructions for a parsing machine.
+type Program struct {
+	code  []instr
+	rules []programRule
+	index map[string]int // of rules by name
+
+	// the tables which instructions refer to
+	names     []string // of nodes
+	literals  []programLiteral
+	classes   []programClass
+	wildcards []programWildcard
+}
+
+type programRule struct {
+	name      string
+	entry     int
+	leftover  leftover
+	recursive bool // see ruleSet.leftRecursive
+}
+
+type programLiteral struct {
+	chars    []string
+	expected string
+}
+
+type programClass struct {
+	negated  bool
+	ranges   []RuneRange
+	expected string
+}
+
+type programWildcard struct {
+	except   string
+	expected string
+}
+
+/*
+	A rule which fails leaves the lexer wherever its parser did, which
+	the caller moves back from. Only the end of the input is reported
+	by position rather than by what was expected there, as when a rule
+	made only of predicates fails, so the position matters there.
+	Choice always returns to where it was made, but And is left at the
+	start of the child which failed, and a literal at the character
+	which didn't match.
+*/
+
+type leftover uint8
+
+const (
+	leaveAtStart leftover = iota // the start of the rule
+	leaveAtMark                  // the start of the last child of And
+	leaveAsIs                    // wherever a literal or a call left it
+)
+
+type opcode uint8
+
+type instr struct {
+	op      opcode
+	a, b, c int
+}
+
+const (
+	opReturn      opcode = iota // the rule has matched
+	opLiteral                   // matches the literal a, as a node named b
+	opClass                     // matches a rune in the class a, as a leaf named b
+	opWildcard                  // matches a rune but those of wildcard a, as a leaf named b
+	opEOF                       // matches the end of the input, as a node named b
+	opEmpty                     // matches nothing, as a node named b
+	opCall                      // matches the rule a
+	opJump                      // goes to a
+	opChoice                    // saves the state, to return to at a should what follows fail
+	opCommit                    // discards the last choice, and goes to a
+	opFail                      // returns to the last choice
+	opPredicate                 // saves the state, including what was expected, to return to at a
+	opBackCommit                // returns to the last predicate as if it had matched, and goes to a
+	opFailTwice                 // returns to the last predicate, and fails
+	opOpen                      // begins a node
+	opClose                     // ends the node, named b, begun by the last open
+	opMark                      // records where a child of the top And begins
+	opMany                      // repeats from a, unless what followed the choice matched nothing
+	opRepeat                    // repeats from a up to c times, unless b were matched and the last matched nothing
+	opRepeatEnd                 // fails if fewer than a were matched, or closes the node, named b
+	opRecover                   // saves the state, including what was expected, to skip from at a
+	opRecovered                 // discards the last recovery point, and goes to a
+	opSkipTry                   // saves the state, to advance at a should the sync fail
+	opSkipDone                  // the sync matched, so the error ends here, and goes to a
+	opSkipAdvance               // skips a rune, and tries the sync again from a
+	opCount
+)
+
+// describes what the operands of an instruction refer to
+type operand uint8
+
+const (
+	argNone operand = iota
+	argTarget
+	argName
+	argLiteral
+	argClass
+	argWildcard
+	argRule
+	argCount
+)
+
+var opcodes = [opCount]struct {
+	name    string
+	a, b, c operand
+}{
+	opReturn:      {"return", argNone, argNone, argNone},
+	opLiteral:     {"literal", argLiteral, argName, argNone},
+	opClass:       {"class", argClass, argName, argNone},
+	opWildcard:    {"wildcard", argWildcard, argName, argNone},
+	opEOF:         {"eof", argNone, argName, argNone},
+	opEmpty:       {"empty", argNone, argName, argNone},
+	opCall:        {"call", argRule, argNone, argNone},
+	opJump:        {"jump", argTarget, argNone, argNone},
+	opChoice:      {"choice", argTarget, argNone, argNone},
+	opCommit:      {"commit", argTarget, argNone, argNone},
+	opFail:        {"fail", argNone, argNone, argNone},
+	opPredicate:   {"predicate", argTarget, argNone, argNone},
+	opBackCommit:  {"backcommit", argTarget, argNone, argNone},
+	opFailTwice:   {"failtwice", argNone, argNone, argNone},
+	opOpen:        {"open", argNone, argNone, argNone},
+	opClose:       {"close", argNone, argName, argNone},
+	opMark:        {"mark", argNone, argNone, argNone},
+	opMany:        {"many", argTarget, argNone, argNone},
+	opRepeat:      {"repeat", argTarget, argCount, argCount},
+	opRepeatEnd:   {"repeatend", argCount, argName, argNone},
+	opRecover:     {"recover", argTarget, argNone, argNone},
+	opRecovered:   {"recovered", argTarget, argNone, argNone},
+	opSkipTry:     {"skiptry", argTarget, argNone, argNone},
+	opSkipDone:    {"skipdone", argTarget, argNone, argNone},
+	opSkipAdvance: {"skipadvance", argTarget, argNone, argNone},
+}
+
+// compiles the grammar to a Program, returning the first
+// *GrammarError encountered as Compile does
+func (g Grammar) CompileProgram() (*Program, error) {
+	c, err := g.Compile()
+	if err != nil {
+		return nil, err
+	}
+	return c.Program(), nil
+}
+
+// compiles the rules of the grammar to a Program, e.g. for a grammar
+// compiled with CompileLeftRecursive. Actions aren't carried over.
+func (c *CompiledGrammar) Program() *Program {
+	pc := &programCompiler{
+		c:     c,
+		p:     &Program{index: map[string]int{}},
+		names: map[string]int{},
+	}
+	names := c.grammar.names()
+
+	for i, name := range names {
+		pc.p.rules = append(pc.p.rules, programRule{name: name})
+		pc.p.index[name] = i
+	}
+	for i, name := range names {
+		tree, _ := c.parseRule(name)
+
+		pc.p.rules[i].entry = len(pc.p.code)
+		pc.leftover = leaveAtStart
+		pc.expression(tree, name)
+		pc.emit(opReturn, 0, 0, 0)
+		pc.p.rules[i].leftover = pc.leftover
+		pc.p.rules[i].recursive = c.leftRecursive(name)
+	}
+	return pc.p
+}
+
+// returns the parser for the given rule, as CompiledGrammar.GetParser
+// does
+func (p *Program) GetParser(s string) (Parser, error) {
+	if _, ok := p.index[s]; !ok {
+		return nil, &GrammarError{Rule: s, Expected: "a rule definition"}
+	}
+	return func(l *Lexer, n ...string) (bool, *Cst) {
+		return apply(p, s, l)
+	}, nil
+}
+
+// parses the entire input with the given rule, as CompiledGrammar.Parse
+// does
+func (p *Program) Parse(rule string, input string) (*Cst, error) {
+	parser, err := p.GetParser(rule)
+	if err != nil {
+		return nil, err
+	}
+
+	l := NewLexer(input)
+	matches, tree := parser(l)
+
+	return finish(l, matches, tree, rule)
+}
+
+// lists the instructions of each rule
+func (p *Program) String() string {
+	var out strings.Builder
+	entries := map[int]string{}
+	for _, r := range p.rules {
+		entries[r.entry] = r.name
+	}
+
+	for pc, in := range p.code {
+		if name, ok := entries[pc]; ok {
+			fmt.Fprintf(&out, "%s:\n", name)
+		}
+		fmt.Fprintf(&out, "%4d  %s", pc, opcodes[in.op].name)
+
+		for i, v := range []int{in.a, in.b, in.c} {
+			switch [3]operand{opcodes[in.op].a, opcodes[in.op].b, opcodes[in.op].c}[i] {
+			case argTarget, argCount:
+				fmt.Fprintf(&out, " %d", v)
+			case argName:
+				fmt.Fprintf(&out, " %q", p.names[v])
+			case argLiteral:
+				fmt.Fprintf(&out, " %s", p.literals[v].expected)
+			case argClass:
+				fmt.Fprintf(&out, " %s", p.classes[v].expected)
+			case argWildcard:
+				fmt.Fprintf(&out, " %s", p.wildcards[v].expected)
+			case argRule:
+				fmt.Fprintf(&out, " %s", p.rules[v].name)
+			}
+		}
+		out.WriteString("\n")
+	}
+	return out.String()
+}
+
+/*
+	Compilation
+*/
+
+// emits the code of each rule, following the same path through the
+// shorthand as expressionToParser and friends
+type programCompiler struct {
+	c     *CompiledGrammar
+	p     *Program
+	names map[string]int
+
+	// where the rule being compiled leaves the lexer when it fails
+	leftover leftover
+}
+
+// appends an instruction, returning its address
+func (pc *programCompiler) emit(op opcode, a int, b int, c int) int {
+	pc.p.code = append(pc.p.code, instr{op, a, b, c})
+	return len(pc.p.code) - 1
+}
+
+// points the instruction at the given address to the next one
+func (pc *programCompiler) patch(at int) {
+	pc.p.code[at].a = len(pc.p.code)
+}
+
+// returns the index of the name of a node, which is the given name if
+// there is one, as in chooseName
+func (pc *programCompiler) name(n string, dflt string) int {
+	if len(n) == 0 {
+		n = dflt
+	}
+	if i, ok := pc.names[n]; ok {
+		return i
+	}
+	pc.names[n] = len(pc.p.names)
+	pc.p.names = append(pc.p.names, n)
+	return pc.names[n]
+}
+
+func (pc *programCompiler) expression(tree *Cst, n string) {
+	sequences := elements(tree)
+	if len(sequences) == 1 {
+		pc.sequence(sequences[0], n)
+		return
+	}
+
+	pc.emit(opOpen, 0, 0, 0)
+	commits := []int{}
+
+	for i, sequence := range sequences {
+		if i == len(sequences)-1 {
+			pc.sequence(sequence, "")
+			break
+		}
+		choice := pc.emit(opChoice, 0, 0, 0)
+		pc.sequence(sequence, "")
+		commits = append(commits, pc.emit(opCommit, 0, 0, 0))
+		pc.patch(choice)
+	}
+	for _, commit := range commits {
+		pc.patch(commit)
+	}
+	pc.emit(opClose, 0, pc.name(n, "Or"), 0)
+
+	if len(n) > 0 {
+		pc.leftover = leaveAtStart
+	}
+}
+
+func (pc *programCompiler) sequence(tree *Cst, n string) {
+	terms := elements(tree)
+	if len(terms) == 1 {
+		pc.prefixed(terms[0], n)
+		return
+	}
+
+	pc.emit(opOpen, 0, 0, 0)
+	for _, term := range terms {
+		if len(n) > 0 {
+			pc.emit(opMark, 0, 0, 0)
+		}
+		pc.prefixed(term, "")
+	}
+	pc.emit(opClose, 0, pc.name(n, "And"), 0)
+
+	if len(n) > 0 {
+		pc.leftover = leaveAtMark
+	}
+}
+
+func (pc *programCompiler) prefixed(tree *Cst, n string) {
+	predicates := tree.nthChild(0).children
+
+	// the innermost predicate is the one nearest the term, as in
+	// prefixedToParser
+	var wrap func(i int, n string)
+	wrap = func(i int, n string) {
+		if i == len(predicates) {
+			pc.term(tree.nthChild(1), n)
+			return
+		}
+
+		predicate := pc.emit(opPredicate, 0, 0, 0)
+		wrap(i+1, "")
+
+		if predicates[i].nthChild(0).value == "!" {
+			pc.emit(opFailTwice, 0, 0, 0)
+			pc.patch(predicate)
+			pc.emit(opEmpty, 0, pc.name(n, "Not"), 0)
+		} else {
+			matched := pc.emit(opBackCommit, 0, 0, 0)
+			pc.patch(predicate)
+			pc.emit(opFail, 0, 0, 0)
+			pc.patch(matched)
+			pc.emit(opEmpty, 0, pc.name(n, "Lookahead"), 0)
+		}
+
+		if len(n) > 0 {
+			pc.leftover = leaveAtStart
+		}
+	}
+	wrap(0, n)
+}
+
+func (pc *programCompiler) term(tree *Cst, n string) {
+	quantifiers := tree.nthChild(1).children
+
+	// each quantifier repeats everything before it
+	var wrap func(i int, n string)
+	wrap = func(i int, n string) {
+		if i < 0 {
+			pc.component(tree.nthChild(0), n)
+			return
+		}
+		inner := func() { wrap(i-1, "") }
+
+		child := quantifiers[i].nthChild(0)
+		switch child.value {
+		case "?":
+			pc.optional(inner, n)
+		case "*":
+			pc.many(inner, n)
+		case "+":
+			pc.repeat(inner, 1, -1, pc.name(n, "OneOrMore"))
+		default:
+			min, max, _ := boundsOf(child, pc.c)
+			pc.repeat(inner, min, max, pc.name(n, "Repeat"))
+		}
+
+		if len(n) > 0 {
+			pc.leftover = leaveAtStart
+		}
+	}
+
+	recovery := tree.nthChild(2)
+	if len(recovery.children) == 0 {
+		wrap(len(quantifiers)-1, n)
+		return
+	}
+
+	// the parser recovered from is given the name, as in Recover
+	skip := pc.emit(opRecover, 0, 0, 0)
+	wrap(len(quantifiers)-1, n)
+	recovered := pc.emit(opRecovered, 0, 0, 0)
+
+	pc.patch(skip)
+	try := pc.emit(opSkipTry, 0, 0, 0)
+	pc.component(recovery.nthChild(0).nthChild(1), "")
+	done := pc.emit(opSkipDone, 0, 0, 0)
+	pc.patch(try)
+	pc.emit(opSkipAdvance, try, 0, 0)
+	pc.patch(recovered)
+	pc.patch(done)
+}
+
+func (pc *programCompiler) component(tree *Cst, n string) {
+	child := tree.nthChild(0)
+
+	switch child.typ {
+	case "literal":
+		chars, _ := literalChars(child, pc.c)
+		pc.p.literals = append(pc.p.literals, newProgramLiteral(chars))
+		pc.emit(opLiteral, len(pc.p.literals)-1, pc.name(n, "And"), 0)
+	case "wildcard":
+		chars, _ := literalChars(child.nthChild(1), pc.c)
+		pc.p.wildcards = append(pc.p.wildcards, newProgramWildcard(strings.Join(chars, "")))
+		pc.emit(opWildcard, len(pc.p.wildcards)-1, pc.name(n, "Wildcard"), 0)
+	case "class":
+		negated, ranges, _ := classRanges(child, pc.c)
+		pc.p.classes = append(pc.p.classes, newProgramClass(negated, ranges))
+		pc.emit(opClass, len(pc.p.classes)-1, pc.name(n, "Class"), 0)
+	case "reference":
+		// the node is named after the rule referred to
+		pc.emit(opCall, pc.p.index[child.Text()], 0, 0)
+	case "end":
+		pc.emit(opEOF, 0, pc.name(n, "EOF"), 0)
+	case "many":
+		pc.many(func() { pc.expression(child.nthChild(1), "") }, n)
+		return
+	case "optional":
+		pc.optional(func() { pc.expression(child.nthChild(1), "") }, n)
+		return
+	case "expression":
+		pc.expression(child, n)
+		return
+	case "And":
+		pc.expression(child.nthChild(1), n)
+		return
+	}
+
+	if len(n) > 0 {
+		pc.leftover = leaveAsIs
+	}
+}
+
+func (pc *programCompiler) many(inner func(), n string) {
+	pc.emit(opOpen, 0, 0, 0)
+	choice := pc.emit(opChoice, 0, 0, 0)
+	inner()
+	// back to what follows the choice, which is kept for the next round
+	pc.emit(opMany, choice+1, 0, 0)
+	pc.patch(choice)
+	pc.emit(opClose, 0, pc.name(n, "Many"), 0)
+}
+
+func (pc *programCompiler) optional(inner func(), n string) {
+	pc.emit(opOpen, 0, 0, 0)
+	choice := pc.emit(opChoice, 0, 0, 0)
+	inner()
+	commit := pc.emit(opCommit, 0, 0, 0)
+	pc.patch(choice)
+	pc.patch(commit)
+	pc.emit(opClose, 0, pc.name(n, "Optional"), 0)
+}
+
+func (pc *programCompiler) repeat(inner func(), min int, max int, name int) {
+	pc.emit(opOpen, 0, 0, 0)
+	skip := -1
+	if max == 0 {
+		skip = pc.emit(opJump, 0, 0, 0)
+	}
+
+	choice := pc.emit(opChoice, 0, 0, 0)
+	inner()
+	pc.emit(opRepeat, choice+1, min, max)
+	pc.patch(choice)
+	if skip >= 0 {
+		pc.patch(skip)
+	}
+	pc.emit(opRepeatEnd, min, name, 0)
+}
+
+func newProgramLiteral(chars []string) programLiteral {
+	return programLiteral{chars, quote(strings.Join(chars, ""))}
+}
+
+func newProgramClass(negated bool, ranges []RuneRange) programClass {
+	return programClass{negated, ranges, describeClass(negated, ranges)}
+}
+
+func newProgramWildcard(except string) programWildcard {
+	return programWildcard{except, describeWildcard(except)}
+}
+
+/*
+	Execution
+*/
+
+// a point to return to when what follows fails
+type entry struct {
+	kind  entryKind
+	next  int
+	pos   int
+	nodes int
+	opens int
+
+	// what was expected, for predicates and recovery points
+	failure failure
+}
+
+type entryKind uint8
+
+const (
+	choiceEntry entryKind = iota
+	predicateEntry
+	recoverEntry
+	skipEntry
+)
+
+// a node begun by open
+type open struct {
+	nodes int
+	start int
+}
+
+func (p *Program) leftRecursive(s string) bool {
+	return p.rules[p.index[s]].recursive
+}
+
+// runs the code of the named rule. Each call has stacks of its own, so
+// that calls may be made through apply.
+func (p *Program) run(s string, l *Lexer) (bool, *Cst) {
+	rule := p.rules[p.index[s]]
+	start, mark := l.pos(), l.pos()
+
+	entries := make([]entry, 0, 8)
+	opens := make([]open, 0, 8)
+	nodes := make([]*Cst, 0, 8)
+
+	// the state to save at a choice
+	save := func(kind entryKind, next int) entry {
+		return entry{kind, next, l.pos(), len(nodes), len(opens), l.failure}
+	}
+	// ends the Error node of a recovery point
+	skipped := func() {
+		node := nodes[len(nodes)-1]
+		node.value = l.input[node.start:l.pos()]
+		l.span(node, node.start)
+	}
+
+	for pc := rule.entry; ; {
+		in := &p.code[pc]
+		failed := false
+		pc++
+
+		switch in.op {
+		case opReturn:
+			return true, nodes[len(nodes)-1]
+
+		case opLiteral:
+			lit := &p.literals[in.a]
+			begin := l.pos()
+			node := NewCst(p.names[in.b])
+
+			for _, char := range lit.chars {
+				if len(char) > l.left() || l.peek(len(char)) != char {
+					l.expectAt(begin, lit.expected)
+					failed = true
+					break
+				}
+				leaf := NewLeaf("Is", char)
+				at := l.pos()
+				l.advance(len(char))
+				node.addChild(l.span(leaf, at))
+			}
+			if !failed {
+				nodes = append(nodes, l.span(node, begin))
+			}
+
+		case opClass:
+			class := &p.classes[in.a]
+			r, w := l.peekNextRune()
+
+			if w == 0 || inRanges(r, class.ranges) == class.negated {
+				l.expect(class.expected)
+				failed = true
+				break
+			}
+			at := l.pos()
+			l.advance(w)
+			nodes = append(nodes, l.span(NewLeaf(p.names[in.b], string(r)), at))
+
+		case opWildcard:
+			wildcard := &p.wildcards[in.a]
+			r, w := l.peekNextRune()
+
+			if w == 0 || strings.ContainsRune(wildcard.except, r) {
+				l.expect(wildcard.expected)
+				failed = true
+				break
+			}
+			at := l.pos()
+			l.advance(w)
+			nodes = append(nodes, l.span(NewLeaf(p.names[in.b], string(r)), at))
+
+		case opEOF:
+			if l.left() > 0 {
+				l.expect("end of input")
+				failed = true
+				break
+			}
+			nodes = append(nodes, l.span(NewCst(p.names[in.b]), l.pos()))
+
+		case opEmpty:
+			nodes = append(nodes, l.span(NewCst(p.names[in.b]), l.pos()))
+
+		case opCall:
+			matches, node := apply(p, p.rules[in.a].name, l)
+			if !matches {
+				failed = true
+				break
+			}
+			nodes = append(nodes, node)
+
+		case opJump:
+			pc = in.a
+
+		case opChoice:
+			entries = append(entries, save(choiceEntry, in.a))
+
+		case opCommit:
+			entries = entries[:len(entries)-1]
+			pc = in.a
+
+		case opFail:
+			failed = true
+
+		case opPredicate:
+			entries = append(entries, save(predicateEntry, in.a))
+
+		case opBackCommit, opFailTwice:
+			e := entries[len(entries)-1]
+			entries = entries[:len(entries)-1]
+
+			// as Not and Lookahead do
+			l.scanTo(e.pos)
+			nodes, opens = nodes[:e.nodes], opens[:e.opens]
+			l.failure = e.failure
+
+			pc = in.a
+			failed = in.op == opFailTwice
+
+		case opOpen:
+			opens = append(opens, open{len(nodes), l.pos()})
+
+		case opClose:
+			nodes, opens = p.close(l, nodes, opens, in.b)
+
+		case opMark:
+			mark = l.pos()
+
+		case opMany:
+			e := &entries[len(entries)-1]
+
+			if l.pos() == e.pos {
+				// stops as Many does
+				nodes = nodes[:e.nodes]
+				entries = entries[:len(entries)-1]
+				break
+			}
+			e.pos, e.nodes = l.pos(), len(nodes)
+			pc = in.a
+
+		case opRepeat:
+			e := &entries[len(entries)-1]
+			matched := len(nodes) - opens[len(opens)-1].nodes
+
+			if (l.pos() == e.pos && matched >= in.b) || (in.c >= 0 && matched >= in.c) {
+				entries = entries[:len(entries)-1]
+				break
+			}
+			e.pos, e.nodes = l.pos(), len(nodes)
+			pc = in.a
+
+		case opRepeatEnd:
+			if len(nodes)-opens[len(opens)-1].nodes < in.a {
+				failed = true
+				break
+			}
+			nodes, opens = p.close(l, nodes, opens, in.b)
+
+		case opRecover:
+			// the failures of the region are kept apart, as in Recover
+			entries = append(entries, save(recoverEntry, in.a))
+			l.failure = failure{pos: -1}
+
+		case opRecovered:
+			e := entries[len(entries)-1]
+			entries = entries[:len(entries)-1]
+
+			// as in Recover
+			l.expectWithin(e.failure, l.failure)
+			pc = in.a
+
+		case opSkipTry:
+			entries = append(entries, save(skipEntry, in.a))
+
+		case opSkipDone:
+			e := entries[len(entries)-1]
+			entries = entries[:len(entries)-1]
+
+			nodes, opens = nodes[:e.nodes], opens[:e.opens]
+			l.failure = e.failure
+			skipped()
+			pc = in.a
+
+		case opSkipAdvance:
+			_, w := l.peekNextRune()
+			if w == 0 {
+				skipped()
+				break
+			}
+			l.advance(w)
+			pc = in.a
+		}
+
+		if !failed {
+			continue
+		}
+
+		if len(entries) == 0 {
+			switch rule.leftover {
+			case leaveAtStart:
+				l.scanTo(start)
+			case leaveAtMark:
+				l.scanTo(mark)
+			}
+			return false, nil
+		}
+
+		// return to the last choice
+		e := entries[len(entries)-1]
+		entries = entries[:len(entries)-1]
+
+		l.scanTo(e.pos)
+		nodes, opens = nodes[:e.nodes], opens[:e.opens]
+		pc = e.next
+
+		switch e.kind {
+		case predicateEntry, skipEntry:
+			l.failure = e.failure
+		case recoverEntry:
+			node := NewCst("Error")
+			node.err = newParseError(l, "")
+			node.start = e.pos
+			nodes = append(nodes, node)
+			l.failure = e.failure
+		}
+	}
+}
+
+// ends the node begun by the last open, with the nodes matched since
+func (p *Program) close(l *Lexer, nodes []*Cst, opens []open, name int) ([]*Cst, []open) {
+	o := opens[len(opens)-1]
+
+	children := make([]*Cst, len(nodes)-o.nodes)
+	copy(children, nodes[o.nodes:])
+	node := l.span(NewCst(p.names[name], children), o.start)
+
+	return append(nodes[:o.nodes], node), opens[:len(opens)-1]
+}
+
+/*
+	Encoding
+
+	A Program is written as a header, then each of its tables and its
+	code, then a checksum of everything before it. Numbers are written
+	as varints, strings and lists are preceded by their lengths, and
+	the descriptions of literals, classes and wildcards are worked out
+	again when the program is read.
+*/
+
+// identifies the encoding, including its version, which changes
+// whenever the instructions do
+const programHeader = "PEGVM\x01"
+
+// encodes the program, see UnmarshalBinary
+func (p *Program) MarshalBinary() ([]byte, error) {
+	e := &encoder{[]byte(programHeader)}
+
+	e.strings(p.names)
+
+	e.int(len(p.literals))
+	for _, lit := range p.literals {
+		e.strings(lit.chars)
+	}
+
+	e.int(len(p.classes))
+	for _, class := range p.classes {
+		e.bool(class.negated)
+		e.int(len(class.ranges))
+		for _, rng := range class.ranges {
+			e.int(int(rng.Lo))
+			e.int(int(rng.Hi))
+		}
+	}
+
+	e.int(len(p.wildcards))
+	for _, wildcard := range p.wildcards {
+		e.string(wildcard.except)
+	}
+
+	e.int(len(p.rules))
+	for _, r := range p.rules {
+		e.string(r.name)
+		e.int(r.entry)
+		e.int(int(r.leftover))
+		e.bool(r.recursive)
+	}
+
+	e.int(len(p.code))
+	for _, in := range p.code {
+		e.int(int(in.op))
+		e.int(in.a)
+		e.int(in.b)
+		e.int(in.c)
+	}
+
+	return binary.BigEndian.AppendUint32(e.data, crc32.ChecksumIEEE(e.data)), nil
+}
+
+// decodes a program written by MarshalBinary, replacing p. Data which
+// is corrupt, or was written by a different version of this package,
+// is rejected with an error wrapping ErrInvalidProgram, as is code
+// which the machine couldn't run safely, see check.
+func (p *Program) UnmarshalBinary(data []byte) error {
+	if len(data) < len(programHeader)+4 || string(data[:len(programHeader)]) != programHeader {
+		return fmt.Errorf("%w: unknown header", ErrInvalidProgram)
+	}
+	body, sum := data[:len(data)-4], data[len(data)-4:]
+	if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(sum) {
+		return fmt.Errorf("%w: checksum mismatch", ErrInvalidProgram)
+	}
+
+	d := &decoder{data: body[len(programHeader):]}
+	q := &Program{index: map[string]int{}}
+
+	q.names = d.strings()
+
+	for i, n := 0, d.len(); i < n; i++ {
+		q.literals = append(q.literals, newProgramLiteral(d.strings()))
+	}
+
+	for i, n := 0, d.len(); i < n; i++ {
+		negated := d.bool()
+		ranges := []RuneRange{}
+		for j, m := 0, d.len(); j < m; j++ {
+			ranges = append(ranges, RuneRange{rune(d.int()), rune(d.int())})
+		}
+		q.classes = append(q.classes, newProgramClass(negated, ranges))
+	}
+
+	for i, n := 0, d.len(); i < n; i++ {
+		q.wildcards = append(q.wildcards, newProgramWildcard(d.string()))
+	}
+
+	for i, n := 0, d.len(); i < n; i++ {
+		r := programRule{d.string(), d.int(), leftover(d.int()), d.bool()}
+		q.index[r.name] = len(q.rules)
+		q.rules = append(q.rules, r)
+	}
+
+	for i, n := 0, d.len(); i < n; i++ {
+		q.code = append(q.code, instr{opcode(d.int()), d.int(), d.int(), d.int()})
+	}
+
+	if d.err == nil && len(d.data) > 0 {
+		d.fail("trailing data")
+	}
+	if d.err != nil {
+		return d.err
+	}
+	if err := q.check(); err != nil {
+		return err
+	}
+
+	*p = *q
+	return nil
+}
+
+// checks that every instruction refers to something which exists, and
+// that the code of every rule keeps its stacks in order, see verify
+func (p *Program) check() error {
+	sizes := map[operand]int{
+		argTarget:   len(p.code),
+		argName:     len(p.names),
+		argLiteral:  len(p.literals),
+		argClass:    len(p.classes),
+		argWildcard: len(p.wildcards),
+		argRule:     len(p.rules),
+	}
+
+	for _, r := range p.rules {
+		if r.entry < 0 || r.entry >= len(p.code) || r.leftover > leaveAsIs {
+			return fmt.Errorf("%w: rule %q", ErrInvalidProgram, r.name)
+		}
+	}
+
+	for pc, in := range p.code {
+		if in.op >= opCount {
+			return fmt.Errorf("%w: unknown opcode %d at %d", ErrInvalidProgram, in.op, pc)
+		}
+
+		spec := opcodes[in.op]
+		for i, v := range []int{in.a, in.b, in.c} {
+			kind := [3]operand{spec.a, spec.b, spec.c}[i]
+			if kind == argNone || kind == argCount {
+				continue
+			}
+			if v < 0 || v >= sizes[kind] {
+				return fmt.Errorf("%w: operand %d of %s out of range at %d",
+					ErrInvalidProgram, v, spec.name, pc)
+			}
+		}
+	}
+
+	// whether each rule may match without consuming input, which is
+	// worked out again until no more rules turn out to
+	nullable := make([]bool, len(p.rules))
+	calls := make([][]int, len(p.rules))
+
+	for changed := true; changed; {
+		changed = false
+		for i := range p.rules {
+			empty, left, err := p.verify(i, nullable)
+			if err != nil {
+				return err
+			}
+			if empty && !nullable[i] {
+				nullable[i], changed = true, true
+			}
+			calls[i] = left
+		}
+	}
+
+	// a rule which may reenter itself without consuming input would
+	// recurse forever unless its seed is grown, whatever it is marked
+	for i := range p.rules {
+		if reaches(calls, i, i) {
+			p.rules[i].recursive = true
+		}
+	}
+	return nil
+}
+
+/*
+	The machine indexes its stacks without checking them, and only
+	loops where it must make progress to go round again, so a program
+	read from elsewhere is run through in the abstract first, following
+	every path through the code of each rule with the shape of the
+	stacks rather than their contents: which choices, predicates,
+	recovery points and nodes are open. Every path must find the stacks
+	in the same shape at the same instruction, each instruction must
+	find on top of them what it pops, and each rule must return with
+	nothing left on them but the node it matched.
+
+	Only many, repeat and skipadvance may go backwards, as the first
+	two repeat only when input was consumed or a node matched since
+	their choice, and the last skips a rune each time round.
+*/
+
+// the shape of the stacks at an instruction
+type stacks struct {
+	frames   []frame
+	grew     bool // whether nodes were added since the top frame was pushed
+	consumed bool // whether the rule has certainly consumed input
+}
+
+// an entry, or a node begun by open
+type frame struct {
+	open bool
+	kind entryKind
+	next int
+
+	// whether the frame below had nodes added, and the rule had
+	// consumed input, when this one was pushed
+	grew     bool
+	consumed bool
+}
+
+func (s stacks) push(f frame) stacks {
+	f.grew, f.consumed = s.grew, s.consumed
+	return stacks{append(s.frames[:len(s.frames):len(s.frames)], f), false, s.consumed}
+}
+
+// pops the top frame, keeping the nodes added since
+func (s stacks) pop() stacks {
+	top := s.frames[len(s.frames)-1]
+	return stacks{s.frames[:len(s.frames)-1], s.grew || top.grew, s.consumed}
+}
+
+// pops the frame at k and those above it, returning to where it was
+// pushed
+func (s stacks) restore(k int) stacks {
+	return stacks{s.frames[:k], s.frames[k].grew, s.frames[k].consumed}
+}
+
+// whether the top frame is the given entry
+func (s stacks) top(kind entryKind) bool {
+	n := len(s.frames)
+	return n > 0 && !s.frames[n-1].open && s.frames[n-1].kind == kind
+}
+
+// merges the stacks of two paths to the same instruction, which must
+// be of the same shape, keeping only what holds for both
+func (s stacks) merge(t stacks) (stacks, bool) {
+	if len(s.frames) != len(t.frames) {
+		return s, false
+	}
+	frames := make([]frame, len(s.frames))
+	for i, f := range s.frames {
+		g := t.frames[i]
+		if f.open != g.open || f.kind != g.kind || f.next != g.next {
+			return s, false
+		}
+		f.grew, f.consumed = f.grew && g.grew, f.consumed && g.consumed
+		frames[i] = f
+	}
+	return stacks{frames, s.grew && t.grew, s.consumed && t.consumed}, true
+}
+
+func (s stacks) equal(t stacks) bool {
+	if s.grew != t.grew || s.consumed != t.consumed {
+		return false
+	}
+	for i := range s.frames {
+		if s.frames[i] != t.frames[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// follows every path through the code of a rule, given which rules may
+// match without consuming input. Returns whether the rule may too,
+// along with the rules it may call before consuming input.
+func (p *Program) verify(rule int, nullable []bool) (bool, []int, error) {
+	states := map[int]stacks{}
+	work := []int{}
+	empty, left := false, []int{}
+
+	fail := func(pc int, reason string) error {
+		return fmt.Errorf("%w: rule %q: %s at %d", ErrInvalidProgram, p.rules[rule].name, reason, pc)
+	}
+	// continues at the given instruction with the given stacks
+	flow := func(pc int, s stacks) error {
+		if pc >= len(p.code) {
+			return fail(pc, "end of code")
+		}
+		old, ok := states[pc]
+		if ok {
+			merged, same := old.merge(s)
+			if !same {
+				return fail(pc, "stacks differ")
+			}
+			if merged.equal(old) {
+				return nil
+			}
+			s = merged
+		}
+		states[pc] = s
+		work = append(work, pc)
+		return nil
+	}
+	// returns to the last entry, as the machine does when something
+	// fails, unless there is none and the rule fails
+	backtrack := func(s stacks) error {
+		for k := len(s.frames) - 1; k >= 0; k-- {
+			f := s.frames[k]
+			if f.open {
+				continue
+			}
+			t := s.restore(k)
+			if f.kind == recoverEntry {
+				t.grew = true // the error node
+			}
+			return flow(f.next, t)
+		}
+		return nil
+	}
+	// continues at the next instruction with a node added
+	matched := func(pc int, s stacks, consumed bool) error {
+		s.grew, s.consumed = true, s.consumed || consumed
+		return flow(pc+1, s)
+	}
+
+	if err := flow(p.rules[rule].entry, stacks{}); err != nil {
+		return false, nil, err
+	}
+
+	for len(work) > 0 {
+		pc := work[len(work)-1]
+		work = work[:len(work)-1]
+		s, in := states[pc], p.code[pc]
+		n := len(s.frames)
+
+		var err error
+		switch in.op {
+		case opJump, opChoice, opCommit, opPredicate, opBackCommit,
+			opRecover, opRecovered, opSkipTry, opSkipDone:
+			if in.a <= pc {
+				return false, nil, fail(pc, opcodes[in.op].name+" backwards")
+			}
+		case opMany, opRepeat, opSkipAdvance:
+			if in.a > pc {
+				return false, nil, fail(pc, opcodes[in.op].name+" forwards")
+			}
+		}
+
+		switch in.op {
+		case opReturn:
+			if n > 0 || !s.grew {
+				return false, nil, fail(pc, "unbalanced return")
+			}
+			empty = empty || !s.consumed
+
+		case opLiteral:
+			if err = backtrack(s); err == nil {
+				err = matched(pc, s, len(p.literals[in.a].chars) > 0)
+			}
+
+		case opClass, opWildcard:
+			if err = backtrack(s); err == nil {
+				err = matched(pc, s, true)
+			}
+
+		case opEOF:
+			if err = backtrack(s); err == nil {
+				err = matched(pc, s, false)
+			}
+
+		case opEmpty:
+			err = matched(pc, s, false)
+
+		case opCall:
+			if !s.consumed {
+				left = append(left, in.a)
+			}
+			if err = backtrack(s); err == nil {
+				err = matched(pc, s, !nullable[in.a])
+			}
+
+		case opJump:
+			err = flow(in.a, s)
+
+		case opChoice:
+			err = flow(pc+1, s.push(frame{kind: choiceEntry, next: in.a}))
+
+		case opPredicate:
+			err = flow(pc+1, s.push(frame{kind: predicateEntry, next: in.a}))
+
+		case opRecover:
+			err = flow(pc+1, s.push(frame{kind: recoverEntry, next: in.a}))
+
+		case opSkipTry:
+			err = flow(pc+1, s.push(frame{kind: skipEntry, next: in.a}))
+
+		case opOpen:
+			err = flow(pc+1, s.push(frame{open: true}))
+
+		case opCommit:
+			if !s.top(choiceEntry) {
+				return false, nil, fail(pc, "commit without a choice")
+			}
+			err = flow(in.a, s.pop())
+
+		case opRecovered:
+			if !s.top(recoverEntry) {
+				return false, nil, fail(pc, "recovered without a recovery point")
+			}
+			err = flow(in.a, s.pop())
+
+		case opFail:
+			err = backtrack(s)
+
+		case opBackCommit, opFailTwice:
+			if !s.top(predicateEntry) {
+				return false, nil, fail(pc, opcodes[in.op].name+" without a predicate")
+			}
+			if in.op == opBackCommit {
+				err = flow(in.a, s.restore(n-1))
+			} else {
+				err = backtrack(s.restore(n - 1))
+			}
+
+		case opClose:
+			if n == 0 || !s.frames[n-1].open {
+				return false, nil, fail(pc, "close without an open")
+			}
+			err = matched(pc, s.pop(), false)
+
+		case opMark:
+			err = flow(pc+1, s)
+
+		case opMany, opRepeat:
+			if !s.top(choiceEntry) {
+				return false, nil, fail(pc, opcodes[in.op].name+" without a choice")
+			}
+			if in.op == opRepeat && (n < 2 || !s.frames[n-2].open || !s.grew) {
+				return false, nil, fail(pc, "repeat without an open, or a node to count")
+			}
+
+			// the choice is kept for the next round, from here
+			again := stacks{append([]frame{}, s.frames...), false, s.consumed}
+			again.frames[n-1].grew = s.grew || s.frames[n-1].grew
+			again.frames[n-1].consumed = s.consumed
+			if err = flow(in.a, again); err != nil {
+				break
+			}
+
+			if in.op == opMany {
+				// matched nothing, so drops what it matched
+				t := s.restore(n - 1)
+				t.consumed = s.consumed
+				err = flow(pc+1, t)
+			} else {
+				err = flow(pc+1, s.pop())
+			}
+
+		case opRepeatEnd:
+			if n == 0 || !s.frames[n-1].open {
+				return false, nil, fail(pc, "repeatend without an open")
+			}
+			if err = backtrack(s); err == nil {
+				err = matched(pc, s.pop(), false)
+			}
+
+		case opSkipDone:
+			if !s.top(skipEntry) {
+				return false, nil, fail(pc, "skipdone without a skiptry")
+			}
+			if t := s.restore(n - 1); t.grew {
+				err = flow(in.a, t)
+			} else {
+				err = fail(pc, "skipdone without an error node")
+			}
+
+		case opSkipAdvance:
+			if !s.grew {
+				return false, nil, fail(pc, "skipadvance without an error node")
+			}
+			t := s
+			t.consumed = true
+			if err = flow(in.a, t); err == nil {
+				err = flow(pc+1, s)
+			}
+		}
+
+		if err != nil {
+			return false, nil, err
+		}
+	}
+
+	return empty, left, nil
+}
+
+// whether the rule from may call the rule to, through any others
+func reaches(calls [][]int, from int, to int) bool {
+	seen := make([]bool, len(calls))
+	next := append([]int{}, calls[from]...)
+
+	for len(next) > 0 {
+		r := next[len(next)-1]
+		next = next[:len(next)-1]
+
+		if r == to {
+			return true
+		}
+		if !seen[r] {
+			seen[r] = true
+			next = append(next, calls[r]...)
+		}
+	}
+	return false
+}
+
+type encoder struct {
+	data []byte
+}
+
+func (e *encoder) int(v int) {
+	e.data = binary.AppendVarint(e.data, int64(v))
+}
+
+func (e *encoder) bool(v bool) {
+	if v {
+		e.int(1)
+	} else {
+		e.int(0)
+	}
+}
+
+func (e *encoder) string(s string) {
+	e.int(len(s))
+	e.data = append(e.data, s...)
+}
+
+func (e *encoder) strings(list []string) {
+	e.int(len(list))
+	for _, s := range list {
+		e.string(s)
+	}
+}
+
+// reads what an encoder wrote, remembering the first error, after
+// which everything reads as zero
+type decoder struct {
+	data []byte
+	err  error
+}
+
+func (d *decoder) fail(reason string) {
+	if d.err == nil {
+		d.err = fmt.Errorf("%w: %s", ErrInvalidProgram, reason)
+	}
+	d.data = nil
+}
+
+func (d *decoder) int() int {
+	v, n := binary.Varint(d.data)
+	if n <= 0 || int64(int(v)) != v {
+		d.fail("bad number")
+		return 0
+	}
+	d.data = d.data[n:]
+	return int(v)
+}
+
+// reads the length of a string or list, each element of which takes
+// at least a byte
+func (d *decoder) len() int {
+	n := d.int()
+	if n < 0 || n > len(d.data) {
+		d.fail("bad length")
+		return 0
+	}
+	return n
+}
+
+func (d *decoder) bool() bool {
+	return d.int() != 0
+}
+
+func (d *decoder) string() string {
+	n := d.len()
+	s := string(d.data[:n])
+	d.data = d.data[n:]
+	return s
+}
+
+func (d *decoder) strings() []string {
+	list := []string{}
+	for i, n := 0, d.len(); i < n; i++ {
+		list = append(list, d.string())
+	}
+	return list
+}
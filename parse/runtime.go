@@ -0,0 +1,338 @@
+package parse
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+/////////////////////// Trees & Errors ////////////////////////
+
+/*
+	Trees, positions and parse errors are the same however a grammar
+	is run. Generate copies everything below the imports of this file
+	into each parser it writes (see generate.go), so that the trees and
+	errors of a generated parser are those of this package. It may
+	depend on the standard library alone, and not on anything declared
+	in the rest of the package.
+*/
+
+// A Position is a location within the input.
+type Position struct {
+	Offset int // byte offset, starting at 0
+	Line   int // line number, starting at 1
+	Column int // column in runes, starting at 1
+}
+
+// A Span is the range of input matched by a Cst node.
+type Span struct {
+	Start Position
+	End   Position
+}
+
+// the input, along with the offset at which each line begins
+type source struct {
+	input string
+	lines []int
+}
+
+func newSource(s string) *source {
+	lines := []int{0}
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\n' {
+			lines = append(lines, i+1)
+		}
+	}
+	return &source{s, lines}
+}
+
+func (s *source) locate(offset int) Position {
+	// find the last line starting at or before the offset
+	line := sort.Search(len(s.lines), func(i int) bool {
+		return s.lines[i] > offset
+	}) - 1
+
+	column := utf8.RuneCountInString(s.input[s.lines[line]:offset]) + 1
+
+	return Position{offset, line + 1, column}
+}
+
+// describes the rune at the given offset for use in error messages
+func (s *source) runeAt(offset int, atEnd string) string {
+	r, w := utf8.DecodeRuneInString(s.input[offset:])
+	if w == 0 {
+		return atEnd
+	}
+	return strconv.QuoteRune(r)
+}
+
+// describes the furthest point at which a parser failed, or the given
+// offset if none recorded what it expected
+func (s *source) failedAt(f failure, offset int, rule string) *ParseError {
+	// predicates don't say what they expected, so a parser made of
+	// nothing else may fail without recording anything
+	if f.pos >= 0 {
+		offset = f.pos
+	}
+
+	return &ParseError{
+		Rule:     rule,
+		Position: s.locate(offset),
+		Expected: f.expected,
+		Found:    s.runeAt(offset, "end of input"),
+	}
+}
+
+// A Cst is a concrete syntax tree, as built by a parser.
+type Cst struct {
+	typ      string
+	children []*Cst
+	value    string
+
+	// the value computed by an action, if any
+	result interface{}
+
+	// the error recovered from, for Error nodes
+	err *ParseError
+
+	// byte offsets of the matched input within src
+	src        *source
+	start, end int
+}
+
+// creates a node of the given type, optionally with children
+func NewCst(name string, optionalChildren ...[]*Cst) *Cst {
+	newAst := &Cst{
+		typ:      name,
+		children: []*Cst{},
+	}
+	if len(optionalChildren) == 1 {
+		newAst.children = optionalChildren[0]
+	}
+	return newAst
+}
+
+// creates a childless node holding the given value, as produced by Is
+// or Wildcard
+func NewLeaf(name string, value string) *Cst {
+	leaf := NewCst(name)
+	leaf.value = value
+	return leaf
+}
+
+func (a *Cst) addChild(child *Cst) {
+	a.children = append(a.children, child)
+}
+
+// returns the name of the rule or combinator which produced the node
+func (a *Cst) Type() string {
+	return a.typ
+}
+
+// returns the input matched by a leaf node, or "" for inner nodes
+func (a *Cst) Value() string {
+	return a.value
+}
+
+// returns the children of the node, which must not be modified
+func (a *Cst) Children() []*Cst {
+	return a.children
+}
+
+// returns the error which the node stands in for, if it is an Error
+// node, or nil otherwise
+func (a *Cst) Err() *ParseError {
+	return a.err
+}
+
+// returns the errors recovered from anywhere within the node, in order
+func (a *Cst) Errors() []*ParseError {
+	errs := []*ParseError{}
+	a.collectErrors(&errs)
+	return errs
+}
+
+func (a *Cst) collectErrors(errs *[]*ParseError) {
+	if a.err != nil {
+		*errs = append(*errs, a.err)
+	}
+	for _, child := range a.children {
+		child.collectErrors(errs)
+	}
+}
+
+// returns the nth child of the node, or nil if there is none
+func (a *Cst) Child(n int) *Cst {
+	if n < 0 || n >= len(a.children) {
+		return nil
+	}
+	return a.children[n]
+}
+
+// returns the first child of the given type, or nil if there is none
+func (a *Cst) ChildByType(name string) *Cst {
+	for _, child := range a.children {
+		if child.typ == name {
+			return child
+		}
+	}
+	return nil
+}
+
+// returns the values of all of the leaves below the node, in order
+func (a *Cst) Text() string {
+	if len(a.children) == 0 {
+		return a.value
+	}
+
+	var text strings.Builder
+	a.writeText(&text)
+	return text.String()
+}
+
+func (a *Cst) writeText(text *strings.Builder) {
+	text.WriteString(a.value)
+	for _, child := range a.children {
+		child.writeText(text)
+	}
+}
+
+// returns the range of input matched by the node. Nodes which were
+// not produced by a parser have an empty span.
+func (a *Cst) Span() Span {
+	if a.src == nil {
+		return Span{}
+	}
+	return Span{a.src.locate(a.start), a.src.locate(a.end)}
+}
+
+func (t Cst) String() string {
+	output := t.typ
+
+	if len(t.value) > 0 {
+		output += "<" + t.value + ">"
+	}
+
+	childRepr := ""
+	for _, child := range t.children {
+		childRepr += ", " + child.String()
+	}
+
+	if len(childRepr) > 0 {
+		output += "(" + childRepr[2:] + ")"
+	}
+
+	return output
+}
+
+// A ParseError describes input that a parser failed to match.
+type ParseError struct {
+	Rule string // name of the rule being parsed, if known
+	Position
+	Expected []string // literals, classes and rules that could have matched
+	Found    string   // the input at Position
+	Err      error    // the error returned by an action, if any
+}
+
+func (e *ParseError) Error() string {
+	msg := fmt.Sprintf("line %d col %d: unexpected %s",
+		e.Line, e.Column, e.Found)
+
+	if len(e.Expected) > 0 {
+		msg = fmt.Sprintf("line %d col %d: expected %s, found %s",
+			e.Line, e.Column, oneOf(e.Expected), e.Found)
+	}
+	if e.Err != nil {
+		msg = fmt.Sprintf("line %d col %d: %v", e.Line, e.Column, e.Err)
+	}
+
+	if len(e.Rule) > 0 {
+		msg = fmt.Sprintf("parsing %q: %s", e.Rule, msg)
+	}
+	return msg
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// ParseErrors lists the errors recovered from while parsing, in the
+// order they occurred in the input.
+type ParseErrors []*ParseError
+
+func (e ParseErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+func (e ParseErrors) Unwrap() []error {
+	errs := make([]error, len(e))
+	for i, err := range e {
+		errs[i] = err
+	}
+	return errs
+}
+
+// the furthest position at which a parser failed to match, and what
+// each parser which failed there expected to find
+type failure struct {
+	pos      int
+	expected []string
+}
+
+// records that the given thing was expected at pos
+func (f *failure) expectAt(pos int, expected string) {
+	switch {
+	case pos > f.pos:
+		*f = failure{pos, []string{expected}}
+	case pos == f.pos:
+		for _, e := range f.expected {
+			if e == expected {
+				return
+			}
+		}
+		f.expected = append(f.expected, expected)
+	}
+}
+
+// replaces whatever was expected at start since the given mark with a
+// single description, e.g. the name of a rule
+func (f *failure) instead(mark failure, start int, expected string) {
+	if f.pos != start {
+		return
+	}
+
+	*f = mark
+	if mark.pos == start {
+		// copy, rather than append to the mark's entries
+		f.expected = mark.expected[:len(mark.expected):len(mark.expected)]
+	}
+	f.expectAt(start, expected)
+}
+
+// adds whatever was expected within a region, for which the failure was
+// cleared, to whatever was expected before it
+func (f *failure) within(mark failure, inner failure) {
+	*f = mark
+	if mark.pos >= 0 {
+		// copy, rather than append to the mark's entries
+		f.expected = mark.expected[:len(mark.expected):len(mark.expected)]
+	}
+	for _, expected := range inner.expected {
+		f.expectAt(inner.pos, expected)
+	}
+}
+
+// lists alternatives, e.g. "a, b or c"
+func oneOf(alternatives []string) string {
+	if len(alternatives) == 1 {
+		return alternatives[0]
+	}
+	last := len(alternatives) - 1
+	return strings.Join(alternatives[:last], ", ") + " or " + alternatives[last]
+}
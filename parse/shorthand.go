@@ -1,12 +1,13 @@
 package parse
 
 import (
-	"fmt"
-	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
 )
 
-const verbose = false
-
 /////////////////////// Grammar Rules ////////////////////////
 
 type Grammar map[string]string
@@ -19,14 +20,166 @@ func (g Grammar) has(i string) bool {
 	}
 }
 
+// returns the names of the rules, in alphabetical order
+func (g Grammar) names() []string {
+	names := make([]string, 0, len(g))
+	for name := range g {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// returns the text of the rule, without the whitespace between the
+// elements of the shorthand
 func (g Grammar) Rule(s string) string {
-	rule := g[s]
-	return RmWhiteSpace(rule)
+	rule, _ := stripRule(g[s])
+	return rule
 }
 
-var parserCache = map[string]Parser{}
+// Removes the whitespace and comments between the elements of a rule,
+// keeping the contents of literals and classes exactly as written.
+// Comments run from # or // to the end of the line, or from /* to the
+// next */, so that alternatives may be explained in place. Also returns
+// the offset of each remaining byte within the original rule (plus
+// the end of the rule), so that errors can point back at the text the
+// grammar author wrote.
+func stripRule(rule string) (string, []int) {
+	stripped := make([]byte, 0, len(rule))
+	offsets := make([]int, 0, len(rule)+1)
+
+	keep := func(i int) {
+		stripped = append(stripped, rule[i])
+		offsets = append(offsets, i)
+	}
+
+	for i := 0; i < len(rule); i++ {
+		switch rule[i] {
+		case ' ', '\n', '\t', '\r':
+			continue
+		case '#':
+			i = skipComment(rule, i, "\n")
+			continue
+		case '/':
+			if strings.HasPrefix(rule[i:], "//") {
+				i = skipComment(rule, i, "\n")
+				continue
+			}
+			// an unclosed comment is kept, for the parser to reject
+			if strings.HasPrefix(rule[i:], "/*") && strings.Contains(rule[i+2:], "*/") {
+				i = skipComment(rule, i+2, "*/")
+				continue
+			}
+		case '\'':
+			// keep everything up to the closing quote, which may be
+			// escaped within the literal
+			keep(i)
+			for i++; i < len(rule) && rule[i] != '\''; i++ {
+				if rule[i] == '\\' && i+1 < len(rule) {
+					keep(i)
+					i++
+				}
+				keep(i)
+			}
+		case '<':
+			// keep everything up to the closing bracket, which may
+			// be escaped within the class
+			keep(i)
+			for i++; i < len(rule) && rule[i] != '>'; i++ {
+				if rule[i] == '\\' && i+1 < len(rule) {
+					keep(i)
+					i++
+				}
+				keep(i)
+			}
+		}
+		if i < len(rule) {
+			keep(i)
+		}
+	}
+	offsets = append(offsets, len(rule))
 
-func (g Grammar) GetParser(s string) Parser {
+	return string(stripped), offsets
+}
+
+// returns the offset of the last byte of the comment starting at i,
+// which runs until the given terminator or the end of the rule
+func skipComment(rule string, i int, terminator string) int {
+	end := strings.Index(rule[i:], terminator)
+	if end < 0 {
+		return len(rule) - 1
+	}
+	return i + end + len(terminator) - 1
+}
+
+// A CompiledGrammar owns the parsers generated from the rules of a
+// Grammar. Every reference is resolved against its own rule table,
+// so any number of grammars (or versions of the same grammar) may
+// be compiled and used side by side.
+type CompiledGrammar struct {
+	grammar Grammar
+	rules   map[string]Parser
+	actions map[string]Action
+
+	// what is known of the rules before they are compiled, computed
+	// when first needed
+	analyzed *Analysis
+
+	// the rules which may call themselves before consuming input,
+	// which the lexer must track while they are in progress, and
+	// whether they are allowed at all
+	recursive          map[string]bool
+	allowLeftRecursion bool
+
+	// the rule currently being compiled, and the offsets of its
+	// stripped text within the original rule
+	rule    string
+	offsets []int
+}
+
+func newCompiledGrammar(g Grammar) *CompiledGrammar {
+	rules := Grammar{}
+	for name, rule := range g {
+		rules[name] = rule
+	}
+	return &CompiledGrammar{
+		grammar:   rules,
+		rules:     map[string]Parser{},
+		actions:   map[string]Action{},
+		recursive: map[string]bool{},
+	}
+}
+
+// generates the parser for every rule in the grammar, returning the
+// first *GrammarError encountered. Left recursive rules are rejected
+// with an error wrapping ErrLeftRecursion, see CompileLeftRecursive.
+func (g Grammar) Compile() (*CompiledGrammar, error) {
+	return newCompiledGrammar(g).compile()
+}
+
+// compiles the grammar as Compile does, but allows left recursive
+// rules, which are parsed by growing a seed match (see packrat.go)
+func (g Grammar) CompileLeftRecursive() (*CompiledGrammar, error) {
+	c := newCompiledGrammar(g)
+	c.allowLeftRecursion = true
+	return c.compile()
+}
+
+func (c *CompiledGrammar) compile() (*CompiledGrammar, error) {
+	for _, name := range c.grammar.names() {
+		if _, err := c.GetParser(name); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// compiles the grammar and returns the parser for the given rule
+func (g Grammar) GetParser(s string) (Parser, error) {
+	return newCompiledGrammar(g).GetParser(s)
+}
+
+func (c *CompiledGrammar) GetParser(s string) (Parser, error) {
 
 	// if seen before, and finished:
 	// 		return memoized value
@@ -35,39 +188,136 @@ func (g Grammar) GetParser(s string) Parser {
 	// if not seen before,
 	// 		return expressionToParser(rule(s))
 
-	if v, ok := parserCache[s]; ok {
-		if v == nil {
-			return func(l *Lexer, n ...string) (bool, *Cst) {
-				// we must defer the access of the map until parser
-				// runtime, otherwise recursively defined grammars
-				// would not ever finish compiling
-				return parserCache[s](l, s)
-			}
-		} else {
-			return func(l *Lexer, n ...string) (bool, *Cst) {
-				return v(l, s) // pass the name of the parser
-			}
-		}
+	if _, ok := c.rules[s]; ok {
+		return func(l *Lexer, n ...string) (bool, *Cst) {
+			// we must defer the access of the map until parser
+			// runtime, otherwise recursively defined grammars
+			// would not ever finish compiling
+			return apply(c, s, l)
+		}, nil
+	}
+
+	if !c.grammar.has(s) {
+		return nil, &GrammarError{Rule: s, Expected: "a rule definition"}
+	}
+
+	// references to other rules are compiled while this one is in
+	// progress, so put back whatever was being compiled before
+	prevRule, prevOffsets := c.rule, c.offsets
+	defer func() {
+		c.rule, c.offsets = prevRule, prevOffsets
+	}()
+
+	tree, err := c.parseRule(s)
+	if err != nil {
+		return nil, err
 	}
 
-	lex := NewLexer(g.Rule(s))
+	path := c.analysis().cycle(s)
+	if path != nil && !c.allowLeftRecursion {
+		return nil, leftRecursionError(path)
+	}
+	c.recursive[s] = path != nil
+	c.rules[s] = nil
+
+	parser, err := expressionToParser(tree, c)
+	if err != nil {
+		delete(c.rules, s)
+		return nil, err
+	}
+	c.rules[s] = parser
+
+	return func(l *Lexer, n ...string) (bool, *Cst) {
+		return apply(c, s, l)
+	}, nil
+}
+
+// parses the shorthand of the named rule, which becomes the rule being
+// compiled
+func (c *CompiledGrammar) parseRule(s string) (*Cst, error) {
+	rule, offsets := stripRule(c.grammar[s])
+	lex := NewLexer(rule)
 	matches, tree := expression(lex)
 
-	if verbose {
-		fmt.Println("Generating Parser: ", s, "=>", g.Rule(s))
+	c.rule, c.offsets = s, offsets
+
+	if pos := lex.failure.pos; pos > lex.pos() {
+		// something was left unfinished further along, such as an
+		// unclosed bracket
+		return nil, c.errorAt(pos, oneOf(lex.failure.expected),
+			foundAt(lex, pos, "end of rule"))
+	}
+	if !matches {
+		return nil, c.errorAt(0, "an expression", found(lex, "end of rule"))
+	}
+	if lex.left() > 0 {
+		return nil, c.errorAt(lex.pos(), "end of rule", found(lex, ""))
 	}
+	return tree, nil
+}
 
-	parserCache[s] = nil
+// parses the entire input with the given rule. If errors were
+// recovered from, see Recover, the partial tree is returned along with
+// ParseErrors listing every one of them.
+func (c *CompiledGrammar) Parse(rule string, input string) (*Cst, error) {
+	p, err := c.GetParser(rule)
+	if err != nil {
+		return nil, err
+	}
 
-	if matches && lex.left() == 0 {
-		parserCache[s] = expressionToParser(tree, g)
+	l := NewLexer(input)
+	matches, tree := p(l)
 
-		return func(l *Lexer, n ...string) (bool, *Cst) {
-			return parserCache[s](l, s) // pass the name of the parser
-		}
-	} else {
-		fmt.Println("Invalid Parser Expression!")
-		return nil
+	return finish(l, matches, tree, rule)
+}
+
+// sets the action which computes the value of the given rule whenever
+// it matches, replacing any previous action. See Map.
+func (c *CompiledGrammar) SetAction(rule string, f Action) error {
+	if !c.grammar.has(rule) {
+		return &GrammarError{Rule: rule, Expected: "a rule definition"}
+	}
+	c.actions[rule] = f
+	return nil
+}
+
+// parses the entire input with the given rule, returning the value
+// computed by the action of the rule
+func (c *CompiledGrammar) Eval(rule string, input string) (interface{}, error) {
+	tree, err := c.Parse(rule, input)
+	if err != nil {
+		return nil, err
+	}
+	return tree.Result(), nil
+}
+
+// parses the body of the named rule, applying its action if it has one
+func (c *CompiledGrammar) run(s string, l *Lexer) (bool, *Cst) {
+	start := l.pos()
+	matches, node := c.rules[s](l, s) // pass the name of the parser
+
+	if f, ok := c.actions[s]; ok && matches {
+		return runAction(l, start, node, f)
+	}
+	return matches, node
+}
+
+func (c *CompiledGrammar) leftRecursive(s string) bool {
+	return c.recursive[s]
+}
+
+// builds a *GrammarError for the rule being compiled, given an offset
+// into its stripped text
+func (c *CompiledGrammar) errorAt(pos int, expected string, found string) error {
+	offset := 0
+	if pos < len(c.offsets) {
+		offset = c.offsets[pos]
+	}
+	return &GrammarError{
+		Rule:     c.rule,
+		Offset:   offset,
+		Expected: expected,
+		Found:    found,
 	}
 }
 
@@ -92,8 +342,12 @@ func (g Grammar) GetParser(s string) Parser {
 	'numbers' and there is no infinite recursive loop.
 */
 
-// literal -> ' & * & '
-// reference -> character [character]
+// literal -> ' & [ escape | *'\'\\' ] & '
+// escape -> \ & *''
+// class -> < & (^) & [ classChar & ( - & classChar ) ] & >
+// reference -> <a-zA-Z_> & [character]
+// character -> <a-zA-Z0-9_>
+// end -> $
 // many -> [ & expression & ]
 // and -> "&"
 // or -> "|"
@@ -106,23 +360,25 @@ func (g Grammar) GetParser(s string) Parser {
 // 			  | optional
 // 			  | { & expression & }
 // 			  | wildcard
-// expression -> component [ or component ]
-// 			  |  component [ and component ]
+// 			  | class
+// 			  | end
+// quantifier -> ? | * | + | { & (digits) & ( , & (digits) ) & }
+// recovery -> ~ & component
+// term -> component [quantifier] (recovery)
+// prefixed -> [ ! | & ] & term
+// sequence -> prefixed [ and & prefixed ]
+// expression -> sequence [ or & sequence ]
 
 func wildcard(l *Lexer, n ...string) (bool, *Cst) {
 	return And(Is(`*`), literal)(l, "wildcard")
 }
 
-func wildcardToParser(tree *Cst, _ Grammar) Parser {
-	exclusions := tree.nthChild(1).nthChild(1)
-
-	except := ""
-
-	for _, child := range exclusions.children {
-		except += child.value
+func wildcardToParser(tree *Cst, c *CompiledGrammar) (Parser, error) {
+	chars, err := literalChars(tree.nthChild(1), c)
+	if err != nil {
+		return nil, err
 	}
-
-	return Wildcard(except)
+	return Wildcard(strings.Join(chars, "")), nil
 }
 
 func and(l *Lexer, n ...string) (bool, *Cst) {
@@ -131,60 +387,199 @@ func and(l *Lexer, n ...string) (bool, *Cst) {
 func or(l *Lexer, n ...string) (bool, *Cst) {
 	return Is("|")(l, "or")
 }
+
+// rule names are identifiers, as in Go: a letter or underscore,
+// followed by any number of letters, digits and underscores
+var identStart = []RuneRange{{'a', 'z'}, {'A', 'Z'}, {'_', '_'}}
+var identChar = append([]RuneRange{{'0', '9'}}, identStart...)
+
 func character(l *Lexer, n ...string) (bool, *Cst) {
-	return Or(
-		Is("q"), Is("w"), Is("e"), Is("r"), Is("t"), Is("y"), Is("u"),
-		Is("i"), Is("o"), Is("p"), Is("a"), Is("s"), Is("d"), Is("f"),
-		Is("g"), Is("h"), Is("j"), Is("k"), Is("l"), Is("z"), Is("x"),
-		Is("c"), Is("v"), Is("b"), Is("n"), Is("m"),
-	)(l, "character")
+	return Class(false, identChar...)(l, "character")
+}
+
+var hexDigit = Class(false, RuneRange{'0', '9'}, RuneRange{'a', 'f'}, RuneRange{'A', 'F'})
+var octDigit = Class(false, RuneRange{'0', '7'})
+
+// a backslash followed by any character, or by the digits of one of
+// Go's numeric escapes
+func escape(l *Lexer, n ...string) (bool, *Cst) {
+	return And(
+		Is(`\`),
+		Or(
+			And(Is("x"), hexDigit, hexDigit),
+			And(Is("u"), hexDigit, hexDigit, hexDigit, hexDigit),
+			And(Is("U"), hexDigit, hexDigit, hexDigit, hexDigit,
+				hexDigit, hexDigit, hexDigit, hexDigit),
+			And(octDigit, octDigit, octDigit),
+			Wildcard(""),
+		),
+	)(l, "escape")
+}
+
+// interprets an escape sequence as in a Go rune literal, e.g. \n or
+// \u00e9, returning its value and whether it stands for a single byte
+// within a string, as \x and octal escapes do. Punctuation may also be
+// escaped to stand for itself, e.g. \"
+func unescapeRune(s string) (rune, bool, bool) {
+	value, multibyte, tail, err := strconv.UnquoteChar(s, '\'')
+
+	if err != nil || len(tail) > 0 {
+		r, w := utf8.DecodeRuneInString(s[1:])
+		if 1+w == len(s) && (unicode.IsPunct(r) || unicode.IsSymbol(r)) {
+			return r, false, true
+		}
+		return 0, false, false
+	}
+	return value, !multibyte, true
+}
+
+// interprets an escape sequence within a literal
+func unescape(s string) (string, bool) {
+	value, isByte, ok := unescapeRune(s)
+	if !ok {
+		return "", false
+	}
+	if isByte {
+		return string([]byte{byte(value)}), true
+	}
+	return string(value), true
+}
+
+// decodes a literalChar or classChar
+func charToString(tree *Cst, c *CompiledGrammar) (string, error) {
+	child := tree.nthChild(0)
+	if child.typ == "Wildcard" {
+		return child.value, nil
+	}
+
+	char, ok := unescape(child.Text())
+	if !ok {
+		return "", c.errorAt(child.start, "a valid escape sequence",
+			strconv.Quote(child.Text()))
+	}
+	return char, nil
+}
+
+func literalChar(l *Lexer, n ...string) (bool, *Cst) {
+	return Or(escape, Wildcard(`'\`))(l, "literalChar")
 }
 
 func literal(l *Lexer, n ...string) (bool, *Cst) {
 	return And(
 		Is("'"),
-		Many(Wildcard("'")),
+		Many(literalChar),
 		Is("'"),
 	)(l, "literal")
 }
 
-// func literalToParser(tree *Cst, _ Grammar) Parser {
-// 	many := tree.nthChild(1)
-// 	lit := ""
+// decodes each of the characters of a literal
+func literalChars(tree *Cst, c *CompiledGrammar) ([]string, error) {
+	chars := []string{}
 
-// 	for _, child := range many.children {
-// 		lit += child.value
-// 	}
-// 	return Is(lit)
-// }
+	for _, child := range tree.nthChild(1).children {
+		char, err := charToString(child, c)
+		if err != nil {
+			return nil, err
+		}
+		chars = append(chars, char)
+	}
+	return chars, nil
+}
 
-func literalToParser(tree *Cst, _ Grammar) Parser {
-	many := tree.nthChild(1)
+func literalToParser(tree *Cst, c *CompiledGrammar) (Parser, error) {
+	chars, err := literalChars(tree, c)
+	if err != nil {
+		return nil, err
+	}
 
 	characterParsers := []Parser{}
 
-	// literal := ""
+	for _, char := range chars {
+		characterParsers = append(characterParsers, Is(char))
+	}
+	return token(And(characterParsers...), quote(strings.Join(chars, ""))), nil
+}
+
+// a character within a class, which may be escaped with a backslash
+func classChar(l *Lexer, n ...string) (bool, *Cst) {
+	return Or(escape, Wildcard(`>\`))(l, "classChar")
+}
+
+func class(l *Lexer, n ...string) (bool, *Cst) {
+	return And(
+		Is("<"),
+		Optional(Is("^")),
+		Many(And(classChar, Optional(And(Is("-"), classChar)))),
+		Is(">"),
+	)(l, "class")
+}
+
+func classCharToRune(tree *Cst, c *CompiledGrammar) (rune, error) {
+	char, err := charToString(tree, c)
+	r, _ := utf8.DecodeRuneInString(char)
+
+	if child := tree.nthChild(0); err == nil && child.typ != "Wildcard" {
+		// as in a Go rune literal, \xe9 stands for é rather than a byte
+		r, _, _ = unescapeRune(child.Text())
+	}
+	return r, err
+}
+
+// decodes whether a class is negated, and each of its ranges
+func classRanges(tree *Cst, c *CompiledGrammar) (bool, []RuneRange, error) {
+	negated := len(tree.nthChild(1).children) > 0
+	ranges := []RuneRange{}
+
+	for _, item := range tree.nthChild(2).children {
+		lo, err := classCharToRune(item.nthChild(0), c)
+		if err != nil {
+			return false, nil, err
+		}
+		hi := lo
+
+		if upper := item.nthChild(1); len(upper.children) > 0 {
+			hi, err = classCharToRune(upper.nthChild(0).nthChild(1), c)
+			if err != nil {
+				return false, nil, err
+			}
+		}
+		if hi < lo {
+			return false, nil, c.errorAt(item.start, "a range in ascending order",
+				strconv.Quote(item.Text()))
+		}
+		ranges = append(ranges, RuneRange{lo, hi})
+	}
+	return negated, ranges, nil
+}
 
-	for _, child := range many.children {
-		characterParsers = append(characterParsers, Is(child.value))
+func classToParser(tree *Cst, c *CompiledGrammar) (Parser, error) {
+	negated, ranges, err := classRanges(tree, c)
+	if err != nil {
+		return nil, err
 	}
-	return And(characterParsers...)
+	return Class(negated, ranges...), nil
 }
 
 func reference(l *Lexer, n ...string) (bool, *Cst) {
-	return OneOrMore(character)(l, "reference")
+	return And(
+		Class(false, identStart...),
+		Many(character),
+	)(l, "reference")
 }
 
-func referenceToParser(tree *Cst, g Grammar) Parser {
-	name := tree.nthChild(0).nthChild(0).value
-	optionalChars := tree.nthChild(1)
+func referenceToParser(tree *Cst, c *CompiledGrammar) (Parser, error) {
+	name := tree.Text()
 
-	if len(optionalChars.children) > 0 {
-		for _, child := range optionalChars.children {
-			name += child.nthChild(0).value
-		}
+	if !c.grammar.has(name) {
+		return nil, c.errorAt(tree.start, "a defined rule",
+			"reference to "+strconv.Quote(name))
 	}
-	return g.GetParser(name)
+	return c.GetParser(name)
+}
+
+// $ anchors a rule to the end of the input
+func end(l *Lexer, n ...string) (bool, *Cst) {
+	return Is("$")(l, "end")
 }
 
 func many(l *Lexer, n ...string) (bool, *Cst) {
@@ -195,9 +590,16 @@ func many(l *Lexer, n ...string) (bool, *Cst) {
 	)(l, "many")
 }
 
-func manyToParser(tree *Cst, g Grammar) Parser {
-	child := tree.nthChild(1)
-	return Many(expressionToParser(child, g))
+func manyToParser(tree *Cst, c *CompiledGrammar) (Parser, error) {
+	if c.analysis().facts(tree.nthChild(1)).nullable {
+		return nil, c.nullableRepetition(tree.start, tree.nthChild(1).Text())
+	}
+
+	child, err := expressionToParser(tree.nthChild(1), c)
+	if err != nil {
+		return nil, err
+	}
+	return Many(child), nil
 }
 
 func optional(l *Lexer, n ...string) (bool, *Cst) {
@@ -208,9 +610,12 @@ func optional(l *Lexer, n ...string) (bool, *Cst) {
 	)(l, "optional")
 }
 
-func optionalToParser(tree *Cst, g Grammar) Parser {
-	child := tree.nthChild(1)
-	return Optional(expressionToParser(child, g))
+func optionalToParser(tree *Cst, c *CompiledGrammar) (Parser, error) {
+	child, err := expressionToParser(tree.nthChild(1), c)
+	if err != nil {
+		return nil, err
+	}
+	return Optional(child), nil
 }
 
 func component(l *Lexer, n ...string) (bool, *Cst) {
@@ -220,72 +625,241 @@ func component(l *Lexer, n ...string) (bool, *Cst) {
 		many,
 		optional,
 		wildcard,
+		class,
+		end,
 		And(Is("{"), expression, Is("}")),
 	)(l, "component")
 }
 
-func componentToParser(tree *Cst, g Grammar) Parser {
+func componentToParser(tree *Cst, c *CompiledGrammar) (Parser, error) {
 	child := tree.nthChild(0)
 	switch child.typ {
 	case "literal":
-		return literalToParser(child, g)
+		return literalToParser(child, c)
 	case "expression":
-		return expressionToParser(child, g)
+		return expressionToParser(child, c)
 	case "reference":
-		return referenceToParser(child, g)
+		return referenceToParser(child, c)
 	case "many":
-		return manyToParser(child, g)
+		return manyToParser(child, c)
 	case "optional":
-		return optionalToParser(child, g)
+		return optionalToParser(child, c)
 	case "wildcard":
-		return wildcardToParser(child, g)
+		return wildcardToParser(child, c)
+	case "class":
+		return classToParser(child, c)
+	case "end":
+		return EOF(), nil
 	case "And":
-		return expressionToParser(child.nthChild(1), g)
+		return expressionToParser(child.nthChild(1), c)
 	}
 
-	fmt.Println("Unexpected Component", child.typ)
-	debug.PrintStack()
-	return nil
+	return nil, c.errorAt(child.start, "a component", child.typ)
 }
 
-func expression(l *Lexer, n ...string) (bool, *Cst) {
-	return Or(
-		And(component, and, Many(And(component, and)), component),
-		And(component, or, Many(And(component, or)), component),
-		component,
-	)(l, "expression")
+// a repetition count such as {2}, {2,} or {2,4}
+func bounds(l *Lexer, n ...string) (bool, *Cst) {
+	count := OneOrMore(Class(false, RuneRange{'0', '9'}))
+	return And(
+		Is("{"),
+		Optional(count),
+		Optional(And(Is(","), Optional(count))),
+		Is("}"),
+	)(l, "bounds")
+}
+
+func quantifier(l *Lexer, n ...string) (bool, *Cst) {
+	return Or(Is("?"), Is("*"), Is("+"), bounds)(l, "quantifier")
+}
+
+// a synchronization point, e.g. ~ { ';' | &'}' }, to which the input
+// is skipped when the term fails. See Recover.
+func recovery(l *Lexer, n ...string) (bool, *Cst) {
+	return And(Is("~"), component)(l, "recovery")
+}
+
+// a component followed by any number of postfix quantifiers, and
+// optionally a point from which to recover
+func term(l *Lexer, n ...string) (bool, *Cst) {
+	return And(component, Many(quantifier), Optional(recovery))(l, "term")
+}
+
+// decodes the minimum and maximum of a repetition count, where a
+// negative maximum means there is none
+func boundsOf(tree *Cst, c *CompiledGrammar) (int, int, error) {
+	count := func(tree *Cst) (int, error) {
+		if len(tree.children) == 0 {
+			return -1, nil
+		}
+		count, err := strconv.Atoi(tree.Text())
+		if err != nil {
+			return 0, c.errorAt(tree.start, "a repetition count", strconv.Quote(tree.Text()))
+		}
+		return count, nil
+	}
+
+	min, err := count(tree.nthChild(1))
+	if err != nil {
+		return 0, 0, err
+	}
+	max := min
+
+	if upper := tree.nthChild(2); len(upper.children) > 0 {
+		if max, err = count(upper.nthChild(0).nthChild(1)); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	if min < 0 && max < 0 {
+		return 0, 0, c.errorAt(tree.start, "a repetition count",
+			strconv.Quote(tree.Text()))
+	}
+	if min < 0 {
+		min = 0
+	}
+	if max >= 0 && max < min {
+		return 0, 0, c.errorAt(tree.start, "bounds in ascending order",
+			strconv.Quote(tree.Text()))
+	}
+	return min, max, nil
+}
+
+func termToParser(tree *Cst, c *CompiledGrammar) (Parser, error) {
+	parser, err := componentToParser(tree.nthChild(0), c)
+	if err != nil {
+		return nil, err
+	}
+	nullable := c.analysis().facts(tree.nthChild(0)).nullable
+
+	for _, quantifier := range tree.nthChild(1).children {
+		child := quantifier.nthChild(0)
+		min, max := 0, 1
+
+		switch child.value {
+		case "?":
+			parser = Optional(parser)
+		case "*":
+			parser, max = Many(parser), -1
+		case "+":
+			parser, min, max = OneOrMore(parser), 1, -1
+		default:
+			min, max, err = boundsOf(child, c)
+			if err != nil {
+				return nil, err
+			}
+			parser = Repeat(parser, min, max)
+		}
+
+		// everything before the quantifier is repeated
+		if nullable && max < 0 {
+			repeated := tree.src.input[tree.start:child.start]
+			return nil, c.nullableRepetition(child.start, repeated)
+		}
+		nullable = nullable || min == 0
+	}
+
+	if recovery := tree.nthChild(2); len(recovery.children) > 0 {
+		sync, err := componentToParser(recovery.nthChild(0).nthChild(1), c)
+		if err != nil {
+			return nil, err
+		}
+		parser = Recover(parser, sync)
+	}
+	return parser, nil
+}
+
+// a term preceded by any number of the predicates ! (not followed
+// by) and & (followed by), neither of which consume input
+func prefixed(l *Lexer, n ...string) (bool, *Cst) {
+	return And(
+		Many(Or(Is("!"), Is("&"))),
+		term,
+	)(l, "prefixed")
+}
+
+func prefixedToParser(tree *Cst, c *CompiledGrammar) (Parser, error) {
+	parser, err := termToParser(tree.nthChild(1), c)
+	if err != nil {
+		return nil, err
+	}
+
+	// the predicate nearest the term applies first
+	predicates := tree.nthChild(0).children
+
+	for i := len(predicates) - 1; i >= 0; i-- {
+		switch predicates[i].nthChild(0).value {
+		case "!":
+			parser = Not(parser)
+		case "&":
+			parser = Lookahead(parser)
+		}
+	}
+	return parser, nil
+}
+
+// a chain of prefixed terms which must all match, in order. Sequences
+// bind more tightly than alternatives, as in EBNF, so that
+//
+//	'a' & 'b' | 'c'
+//
+// is equivalent to { 'a' & 'b' } | 'c'
+func sequence(l *Lexer, n ...string) (bool, *Cst) {
+	return And(
+		prefixed,
+		Many(And(and, prefixed)),
+	)(l, "sequence")
 }
 
-func expressionToParser(tree *Cst, g Grammar) Parser {
-	if tree.nthChild(0).typ == "component" {
-		return componentToParser(tree.nthChild(0), g)
+func sequenceToParser(tree *Cst, c *CompiledGrammar) (Parser, error) {
+	terms := []*Cst{tree.nthChild(0)}
+
+	for _, child := range tree.nthChild(1).children {
+		terms = append(terms, child.nthChild(1))
 	}
 
-	var children = []Parser{
-		componentToParser(tree.nthChild(0).nthChild(0), g),
+	if len(terms) == 1 {
+		return prefixedToParser(terms[0], c)
 	}
 
-	operator := tree.nthChild(0).nthChild(1).typ
-	optionalComponents := tree.nthChild(0).nthChild(2)
+	var children = []Parser{}
 
-	if len(optionalComponents.children) > 0 {
-		for _, child := range optionalComponents.children {
-			optionalComponent := child.nthChild(0)
-			children = append(children,
-				componentToParser(optionalComponent, g))
+	for _, term := range terms {
+		child, err := prefixedToParser(term, c)
+		if err != nil {
+			return nil, err
 		}
+		children = append(children, child)
 	}
+	return And(children...), nil
+}
+
+// a choice between sequences, the first of which to match wins
+func expression(l *Lexer, n ...string) (bool, *Cst) {
+	return And(
+		sequence,
+		Many(And(or, sequence)),
+	)(l, "expression")
+}
 
-	children = append(children,
-		componentToParser(tree.nthChild(0).nthChild(3), g))
+func expressionToParser(tree *Cst, c *CompiledGrammar) (Parser, error) {
+	sequences := []*Cst{tree.nthChild(0)}
 
-	switch operator {
-	case "or":
-		return Or(children...)
-	case "and":
-		return And(children...)
+	for _, child := range tree.nthChild(1).children {
+		sequences = append(sequences, child.nthChild(1))
 	}
 
-	debug.PrintStack()
-	return nil
+	if len(sequences) == 1 {
+		return sequenceToParser(sequences[0], c)
+	}
+
+	var children = []Parser{}
+
+	for _, sequence := range sequences {
+		child, err := sequenceToParser(sequence, c)
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, child)
+	}
+	return Or(children...), nil
 }
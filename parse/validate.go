@@ -0,0 +1,166 @@
+package parse
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+/////////////////////// Validation ////////////////////////
+
+/*
+	Compile gives up at the first rule it can't compile, and a rule
+	which is never referenced goes unnoticed altogether. Validate
+	checks every rule of a grammar before any input is parsed, and
+	reports all of the problems it finds at once:
+
+		- rules whose shorthand can't be compiled
+		- references to rules which aren't defined
+		- rules which no other rule refers to
+		- rules which can't be reached from the start rule
+		- alternatives which are shadowed by earlier ones (see
+		  analysis.go)
+*/
+
+var (
+	// a rule which no other rule refers to
+	ErrUnusedRule = errors.New("unused")
+
+	// a rule which can't be reached by following references from the
+	// start rule, such as one only used by an unused rule
+	ErrUnreachableRule = errors.New("unreachable")
+)
+
+// checks every rule of the grammar, returning GrammarErrors sorted by
+// rule and offset, or nil if the grammar is sound
+func (g Grammar) Validate(start string) error {
+	c := newCompiledGrammar(g)
+	errs := GrammarErrors{}
+	refs := map[string][]string{}
+
+	// every rule is taken as compiled, so that each is compiled alone
+	for _, name := range g.names() {
+		c.rules[name] = nil
+	}
+
+	for _, name := range g.names() {
+		names, invalid := c.references(name)
+		refs[name] = names
+		errs = append(errs, invalid...)
+
+		if len(invalid) > 0 {
+			continue
+		}
+
+		// catch what the shorthand parser can't, such as bad escapes
+		if err := c.compileAlone(name); err != nil {
+			errs = append(errs, err.(*GrammarError))
+		}
+	}
+
+	if err := g.Analyze().ShadowedAlternatives(); err != nil {
+		errs = append(errs, err.(GrammarErrors)...)
+	}
+
+	if !g.has(start) {
+		errs = append(errs, &GrammarError{Rule: start, Expected: "a rule definition"})
+	}
+
+	reachable := map[string]bool{}
+	var visit func(string)
+	visit = func(name string) {
+		if reachable[name] || !g.has(name) {
+			return
+		}
+		reachable[name] = true
+		for _, ref := range refs[name] {
+			visit(ref)
+		}
+	}
+	visit(start)
+
+	referenced := map[string]bool{}
+	for name, names := range refs {
+		for _, ref := range names {
+			if ref != name {
+				referenced[ref] = true
+			}
+		}
+	}
+
+	for _, name := range g.names() {
+		switch {
+		case name == start || reachable[name]:
+		case !referenced[name]:
+			errs = append(errs, &GrammarError{Rule: name, Err: ErrUnusedRule})
+		case g.has(start):
+			errs = append(errs, &GrammarError{
+				Rule: name,
+				Err:  fmt.Errorf("%w from %q", ErrUnreachableRule, start),
+			})
+		}
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	sort.SliceStable(errs, func(i, j int) bool {
+		if errs[i].Rule != errs[j].Rule {
+			return errs[i].Rule < errs[j].Rule
+		}
+		return errs[i].Offset < errs[j].Offset
+	})
+	return errs
+}
+
+// compiles the named rule of a grammar whose rules are all taken as
+// compiled, so that the rules it refers to aren't, and any error is
+// its own, whether or not they have errors of their own
+func (c *CompiledGrammar) compileAlone(s string) error {
+	tree, err := c.parseRule(s)
+	if err != nil {
+		return err
+	}
+	if path := c.analysis().cycle(s); path != nil {
+		return leftRecursionError(path)
+	}
+
+	// references are looked up as the parser runs, which it never will
+	_, err = expressionToParser(tree, c)
+	return err
+}
+
+// returns the names of the rules referred to by the named rule, along
+// with an error for each reference to a rule which isn't defined, or
+// for shorthand which doesn't parse
+func (c *CompiledGrammar) references(s string) ([]string, GrammarErrors) {
+	tree, err := c.parseRule(s)
+	if err != nil {
+		return nil, GrammarErrors{err.(*GrammarError)}
+	}
+
+	names := []string{}
+	errs := GrammarErrors{}
+
+	var walk func(*Cst)
+	walk = func(node *Cst) {
+		if node.typ != "reference" {
+			for _, child := range node.children {
+				walk(child)
+			}
+			return
+		}
+
+		name := node.Text()
+		if !c.grammar.has(name) {
+			err := c.errorAt(node.start, "a defined rule",
+				"reference to "+strconv.Quote(name))
+			errs = append(errs, err.(*GrammarError))
+		}
+		names = append(names, name)
+	}
+	walk(tree)
+
+	return names, errs
+}
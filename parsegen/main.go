@@ -0,0 +1,66 @@
+/*
+Parsegen writes a standalone Go parser for a grammar file, in the
+format read by parse.ParseGrammarFile. The generated file has no
+dependencies beyond the standard library, so it may be checked in
+next to the grammar, e.g. with
+
+	//go:generate parsegen -o json_parser.go json.peg
+
+Usage:
+
+	parsegen [-pkg name] [-o file] grammar.peg
+
+The package defaults to $GOPACKAGE, as set by go generate, and the
+generated Parse function begins with the first rule declared.
+*/
+package main
+
+import (
+	"../parse"
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+)
+
+func main() {
+	pkg := flag.String("pkg", os.Getenv("GOPACKAGE"), "package of the generated file")
+	out := flag.String("o", "", "file to write, rather than standard output")
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: parsegen [-pkg name] [-o file] grammar.peg")
+		os.Exit(2)
+	}
+	if len(*pkg) == 0 {
+		*pkg = "main"
+	}
+
+	if err := generate(flag.Arg(0), *pkg, *out); err != nil {
+		fmt.Fprintln(os.Stderr, "parsegen:", err)
+		os.Exit(1)
+	}
+}
+
+func generate(path string, pkg string, out string) error {
+	text, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	f, err := parse.ParseGrammarFile(bytes.NewReader(text))
+	if err != nil {
+		return fmt.Errorf("%s:\n%s", path, parse.Diagnose(err, string(text), 1))
+	}
+
+	var src bytes.Buffer
+	if err := f.Generate(&src, pkg); err != nil {
+		return fmt.Errorf("%s:\n%s", path, f.Diagnose(err, 1))
+	}
+
+	if len(out) == 0 {
+		_, err = os.Stdout.Write(src.Bytes())
+		return err
+	}
+	return os.WriteFile(out, src.Bytes(), 0644)
+}